@@ -24,6 +24,7 @@ const (
 
 const (
 	AfcOperationStatus         = 0x00000001
+	AfcOperationReadDir        = 0x00000003
 	AfcOperationWriteFile      = 0x00000005
 	AfcOperationMakeDir        = 0x00000009
 	AfcOperationGetFileInfo    = 0x0000000A
@@ -31,10 +32,24 @@ const (
 	AfcOperationFileOpenResult = 0x0000000E
 	AfcOperationFileWrite      = 0x00000010
 	AfcOperationFileClose      = 0x00000014
+	AfcOperationMakeLink       = 0x0000001C
+
+	AfcOperationRemovePathAndContents = 0x00000022
+)
+
+type AfcLinkType uint64
+
+const (
+	AfcLinkTypeHardLink AfcLinkType = 1
+	AfcLinkTypeSymLink  AfcLinkType = 2
 )
 
 const AfcMagic uint64 = 0x4141504c36414643
 
+// afcWriteChunkSize is the amount of file data sent in a single write
+// operation.
+const afcWriteChunkSize = 1 << 20
+
 const (
 	afcESuccess             = 0
 	afcEUnknownError        = 1
@@ -81,7 +96,7 @@ var (
 		afcEOpNotSupported:      errors.New("operation not supported"),
 		afcEObjectExists:        errors.New("object exists"),
 		afcEObjectBusy:          errors.New("object busy"),
-		afcENoSpaceLeft:         errors.New("no space left"),
+		afcENoSpaceLeft:         ErrInsufficientSpace,
 		afcEOpWouldBlock:        errors.New("operation would block"),
 		afcEIoError:             errors.New("io error"),
 		afcEOpInterrupted:       errors.New("operation interrupted"),
@@ -189,6 +204,32 @@ func (a *AFC) WriteFile(filename string, data []byte, mode AfcFileMode) error {
 	return nil
 }
 
+// WriteFileFrom writes the contents of r to the named file in chunks, so that
+// large files do not have to be held in memory.
+func (a *AFC) WriteFileFrom(filename string, r io.Reader, mode AfcFileMode) error {
+	f, err := a.open(filename, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, afcWriteChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err := f.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 func (a *AFC) CreateDirectory(name string) error {
 	dataBuf := new(bytes.Buffer)
 	dataBuf.WriteString(name)
@@ -309,3 +350,109 @@ func (a *AFC) open(filename string, mode AfcFileMode) (*afcFile, error) {
 
 	return &afcFile{a.conn, 0, binary.LittleEndian.Uint64(respData)}, nil
 }
+
+// ReadDirectory returns the names of the entries in the directory, not
+// including "." and "..".
+func (a *AFC) ReadDirectory(name string) ([]string, error) {
+	dataBuf := new(bytes.Buffer)
+	dataBuf.WriteString(name)
+	dataBuf.WriteByte(0)
+
+	respPayload, err := a.request(AfcOperationReadDir, dataBuf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, b := range bytes.Split(respPayload, []byte{0x00}) {
+		name := string(b)
+		if name == "" || name == "." || name == ".." {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// CreateSymlink creates a symbolic link at name pointing to target.
+func (a *AFC) CreateSymlink(target, name string) error {
+	dataBuf := new(bytes.Buffer)
+	if err := binary.Write(dataBuf, binary.LittleEndian, uint64(AfcLinkTypeSymLink)); err != nil {
+		return err
+	}
+	dataBuf.WriteString(target)
+	dataBuf.WriteByte(0)
+	dataBuf.WriteString(name)
+	dataBuf.WriteByte(0)
+
+	_, err := a.request(AfcOperationMakeLink, dataBuf.Bytes())
+	return err
+}
+
+// RemoveAll removes name and everything it contains.
+func (a *AFC) RemoveAll(name string) error {
+	dataBuf := new(bytes.Buffer)
+	dataBuf.WriteString(name)
+	dataBuf.WriteByte(0)
+
+	_, err := a.request(AfcOperationRemovePathAndContents, dataBuf.Bytes())
+	return err
+}
+
+// request sends a single operation with its header data and returns the
+// payload of the response, or the error reported in a status response.
+func (a *AFC) request(operation uint64, data []byte) ([]byte, error) {
+	n := uint64(len(data))
+
+	var magic [8]byte
+	copy(magic[:], "CFA6LPAA")
+
+	req := afcOperationRequest{
+		Magic:        magic,
+		EntireLength: 40 + n,
+		ThisLength:   40 + n,
+		PacketNum:    atomic.AddUint64(&a.packetNum, 1),
+		Operation:    operation,
+	}
+
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, binary.LittleEndian, req); err != nil {
+		return nil, err
+	}
+	buf.Write(data)
+
+	payload := buf.Bytes()
+
+	log.Printf(">> %s\n", payload)
+
+	if _, err := a.conn.Write(payload); err != nil {
+		return nil, err
+	}
+
+	var respHeader afcOperationRequest
+	if err := binary.Read(a.conn, binary.LittleEndian, &respHeader); err != nil {
+		return nil, err
+	}
+
+	respData := make([]byte, respHeader.ThisLength-40)
+	if _, err := io.ReadFull(a.conn, respData); err != nil {
+		return nil, err
+	}
+
+	respPayload := make([]byte, respHeader.EntireLength-respHeader.ThisLength)
+	if _, err := io.ReadFull(a.conn, respPayload); err != nil {
+		return nil, err
+	}
+
+	if respHeader.Operation == AfcOperationStatus {
+		code := binary.LittleEndian.Uint64(respData)
+		if code != afcESuccess {
+			return nil, errorsToErrors[code]
+		}
+	}
+
+	log.Printf("<< %s\n", respPayload)
+
+	return respPayload, nil
+}
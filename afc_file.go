@@ -60,7 +60,10 @@ func (f *afcFile) Write(b []byte) (int, error) {
 
 	if respHeader.Operation == AfcOperationStatus {
 		code := binary.LittleEndian.Uint64(respData)
-		return 0, errorsToErrors[code]
+		if code != afcESuccess {
+			return 0, errorsToErrors[code]
+		}
+		return len(b), nil
 	}
 
 	respPayload := make([]byte, respHeader.EntireLength-respHeader.ThisLength)
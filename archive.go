@@ -0,0 +1,55 @@
+package xcdevice
+
+import (
+	"fmt"
+)
+
+func Archive(device *Device, bundleID string, skipUninstall bool, archiveType ArchiveType, progress ProgressFunc) error {
+	installationProxy, err := installationProxyService(device)
+	if err != nil {
+		return err
+	}
+
+	return installationProxy.Archive(bundleID, skipUninstall, archiveType, progress)
+}
+
+func Restore(device *Device, bundleID string, progress ProgressFunc) error {
+	installationProxy, err := installationProxyService(device)
+	if err != nil {
+		return err
+	}
+
+	return installationProxy.Restore(bundleID, progress)
+}
+
+func RemoveArchive(device *Device, bundleID string, progress ProgressFunc) error {
+	installationProxy, err := installationProxyService(device)
+	if err != nil {
+		return err
+	}
+
+	return installationProxy.RemoveArchive(bundleID, progress)
+}
+
+func LookupArchives(device *Device) (map[string]interface{}, error) {
+	installationProxy, err := installationProxyService(device)
+	if err != nil {
+		return nil, err
+	}
+
+	return installationProxy.LookupArchives()
+}
+
+func installationProxyService(device *Device) (*InstallationProxy, error) {
+	lockdown, err := LockdownService(device)
+	if err != nil {
+		return nil, fmt.Errorf("lockdown: %v", err)
+	}
+
+	installationProxy, err := lockdown.InstallationProxyService()
+	if err != nil {
+		return nil, fmt.Errorf("installation proxy: %v", err)
+	}
+
+	return installationProxy, nil
+}
@@ -0,0 +1,24 @@
+package xcdevice
+
+import (
+	"fmt"
+)
+
+func Browse(device *Device, appType ApplicationType, attributes []string) ([]Application, error) {
+	lockdown, err := LockdownService(device)
+	if err != nil {
+		return nil, fmt.Errorf("lockdown: %v", err)
+	}
+
+	installationProxy, err := lockdown.InstallationProxyService()
+	if err != nil {
+		return nil, fmt.Errorf("installation proxy: %v", err)
+	}
+
+	apps, err := installationProxy.Browse(appType, attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	return apps, nil
+}
@@ -1,13 +1,27 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"image/png"
 	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/romantomjak/xcdevice"
+	"github.com/romantomjak/xcdevice/codesign"
+	"github.com/romantomjak/xcdevice/infoplist"
 )
 
 var (
@@ -29,10 +43,25 @@ func printUsage() {
   xcdevice [flags] [command] [arguments]
 
 Available Commands:
-  install     Install application using an IPA file
+  apps        List installed applications
+  archive     Create, restore, remove or list application archives
+  ddi         Mount, unmount or check developer disk images with "ddi mount|unmount|status"
+  diag        Query diagnostics with "diag all|wifi|gasgauge|ioreg|gestalt", or "diag shutdown|sleep"
+  forward     Forward a local TCP port to a device port, e.g. "forward 8100:8100"
+  install     Install application using an IPA file, IPA URL or .app directory
+  ipa         Inspect IPA files or URLs with "ipa info" or extract the icon with "ipa icon"
   list        List all devices
-  lookup	  Lookup application data by bundle ID
+  lookup      Lookup application data by one or more bundle IDs
+  notify      Post or observe Darwin notifications with "notify post|observe [--insecure] NAME..."
+  oslog       Stream the unified log, or pull a logarchive with "oslog archive"
+  ps          List processes running on the device
+  reboot      Restart the device
+  resign      Re-sign an IPA file with a p12 certificate and provisioning profile
+  screenshot  Save a screenshot of the device as PNG
+  staging     Remove uploaded packages from PublicStaging with "staging clean"
+  syslog      Stream the device's system log
   uninstall   Uninstall application by bundle ID
+  verify      Verify the structure and code signature seal of an IPA file
 
 Flags:
   --device string     specify a device using UDID (default "")
@@ -48,29 +77,432 @@ func main() {
 	}
 
 	switch flag.Arg(0) {
-	case "install":
-		if flag.Arg(1) == "" {
+	case "apps":
+		appsFlags := flag.NewFlagSet("apps", flag.ExitOnError)
+		appType := appsFlags.String("type", string(xcdevice.ApplicationTypeUser), "application type: User, System or Any")
+		asJSON := appsFlags.Bool("json", false, "print applications as JSON")
+		appsFlags.Parse(flag.Args()[1:])
+
+		iphone := mustGetDevice()
+
+		apps, err := xcdevice.Browse(iphone, xcdevice.ApplicationType(*appType), xcdevice.DefaultLookupAttributes)
+		if err != nil {
+			fmt.Printf("browse error: %v\n", err)
+			os.Exit(1)
+		}
+
+		sort.Slice(apps, func(i, j int) bool {
+			return apps[i].BundleID < apps[j].BundleID
+		})
+
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(apps); err != nil {
+				fmt.Printf("failed to encode applications: %v\n", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "BUNDLE ID\tVERSION\tNAME")
+		for _, app := range apps {
+			name := app.DisplayName
+			if name == "" {
+				name = app.Name
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", app.BundleID, app.ShortVersion, name)
+		}
+		w.Flush()
+
+		os.Exit(0)
+
+	case "archive":
+		archiveFlags := flag.NewFlagSet("archive", flag.ExitOnError)
+		skipUninstall := archiveFlags.Bool("skip-uninstall", false, "keep the application installed after archiving it")
+		archiveType := archiveFlags.String("type", string(xcdevice.ArchiveTypeAll), "archive type: All, ApplicationOnly or DocumentsOnly")
+
+		action := flag.Arg(1)
+		if len(flag.Args()) > 2 {
+			archiveFlags.Parse(flag.Args()[2:])
+		}
+		bundleID := archiveFlags.Arg(0)
+
+		if action != "list" && bundleID == "" {
+			printUsage()
+			os.Exit(1)
+		}
+
+		iphone := mustGetDevice()
+
+		var err error
+		switch action {
+		case "create":
+			err = xcdevice.Archive(iphone, bundleID, *skipUninstall, xcdevice.ArchiveType(*archiveType), printProgress)
+		case "restore":
+			err = xcdevice.Restore(iphone, bundleID, printProgress)
+		case "remove":
+			err = xcdevice.RemoveArchive(iphone, bundleID, printProgress)
+		case "list":
+			var archives map[string]interface{}
+			archives, err = xcdevice.LookupArchives(iphone)
+			if err == nil {
+				for _, k := range sortedKeys(archives) {
+					fmt.Println(k)
+				}
+			}
+		default:
+			printUsage()
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Printf("archive error: %v\n", err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+
+	case "ddi":
+		switch flag.Arg(1) {
+		case "mount":
+			mountFlags := flag.NewFlagSet("mount", flag.ExitOnError)
+			signature := mountFlags.String("signature", "", "path of the image signature (default IMAGE.signature)")
+			mountFlags.Parse(flag.Args()[2:])
+
+			path := mountFlags.Arg(0)
+			if path == "" {
+				printUsage()
+				os.Exit(1)
+			}
+
+			fi, err := os.Stat(path)
+			if err != nil {
+				fmt.Printf("ddi error: %v\n", err)
+				os.Exit(1)
+			}
+
+			iphone := mustGetDevice()
+
+			if fi.IsDir() {
+				var image, trustCache, buildManifest []byte
+				image, trustCache, buildManifest, err = xcdevice.ReadPersonalizedImage(path)
+				if err == nil {
+					err = xcdevice.MountPersonalizedImage(iphone, image, trustCache, buildManifest)
+				}
+			} else {
+				if *signature == "" {
+					*signature = path + ".signature"
+				}
+				err = xcdevice.MountDeveloperImage(iphone, path, *signature)
+			}
+			if err != nil {
+				fmt.Printf("ddi error: %v\n", err)
+				os.Exit(1)
+			}
+
+		case "unmount":
+			iphone := mustGetDevice()
+
+			status, err := xcdevice.DeveloperImageStatus(iphone)
+			if err != nil {
+				fmt.Printf("ddi error: %v\n", err)
+				os.Exit(1)
+			}
+
+			mountPath := xcdevice.DeveloperImageMountPath
+			if status.Personalized {
+				mountPath = xcdevice.PersonalizedImageMountPath
+			}
+			if err := xcdevice.UnmountImage(iphone, mountPath); err != nil {
+				fmt.Printf("ddi error: %v\n", err)
+				os.Exit(1)
+			}
+
+		case "status":
+			iphone := mustGetDevice()
+
+			status, err := xcdevice.DeveloperImageStatus(iphone)
+			if err != nil {
+				fmt.Printf("ddi error: %v\n", err)
+				os.Exit(1)
+			}
+
+			switch {
+			case status.Personalized:
+				fmt.Printf("Personalized developer disk image mounted at %s\n", xcdevice.PersonalizedImageMountPath)
+			case status.Developer:
+				fmt.Printf("Developer disk image mounted at %s\n", xcdevice.DeveloperImageMountPath)
+			default:
+				fmt.Println("No developer disk image mounted")
+			}
+
+		default:
+			printUsage()
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+
+	case "diag":
+		// the arguments are validated before looking for a device
+		var diag func(iphone *xcdevice.Device) (map[string]interface{}, error)
+		switch flag.Arg(1) {
+		case "all":
+			diag = func(iphone *xcdevice.Device) (map[string]interface{}, error) {
+				return xcdevice.Diagnostics(iphone, xcdevice.DiagnosticsTypeAll)
+			}
+		case "wifi":
+			diag = func(iphone *xcdevice.Device) (map[string]interface{}, error) {
+				return xcdevice.Diagnostics(iphone, xcdevice.DiagnosticsTypeWiFi)
+			}
+		case "gasgauge":
+			diag = func(iphone *xcdevice.Device) (map[string]interface{}, error) {
+				return xcdevice.Diagnostics(iphone, xcdevice.DiagnosticsTypeGasGauge)
+			}
+		case "ioreg":
+			ioregFlags := flag.NewFlagSet("ioreg", flag.ExitOnError)
+			plane := ioregFlags.String("plane", "", "registry plane, e.g. IOPower")
+			name := ioregFlags.String("name", "", "entry name, e.g. AppleARMPMUCharger")
+			class := ioregFlags.String("class", "", "entry class, e.g. IOPMPowerSource")
+			ioregFlags.Parse(flag.Args()[2:])
+
+			diag = func(iphone *xcdevice.Device) (map[string]interface{}, error) {
+				return xcdevice.IORegistry(iphone, xcdevice.IORegistryQuery{
+					Plane: *plane,
+					Name:  *name,
+					Class: *class,
+				})
+			}
+		case "gestalt":
+			if flag.Arg(2) == "" {
+				printUsage()
+				os.Exit(1)
+			}
+			keys := flag.Args()[2:]
+
+			diag = func(iphone *xcdevice.Device) (map[string]interface{}, error) {
+				return xcdevice.MobileGestalt(iphone, keys...)
+			}
+		case "shutdown":
+			diag = func(iphone *xcdevice.Device) (map[string]interface{}, error) {
+				return nil, xcdevice.ShutdownDevice(iphone)
+			}
+		case "sleep":
+			diag = func(iphone *xcdevice.Device) (map[string]interface{}, error) {
+				return nil, xcdevice.SleepDevice(iphone)
+			}
+		default:
+			printUsage()
+			os.Exit(1)
+		}
+
+		iphone := mustGetDevice()
+
+		result, err := diag(iphone)
+		if err != nil {
+			fmt.Printf("diag error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if result != nil {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(result); err != nil {
+				fmt.Printf("failed to encode diagnostics: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		os.Exit(0)
+
+	case "forward":
+		forwardFlags := flag.NewFlagSet("forward", flag.ExitOnError)
+		bind := forwardFlags.String("bind", "127.0.0.1", "local address to listen on")
+		forwardFlags.Parse(flag.Args()[1:])
+
+		localPort, devicePort, err := parsePortMapping(forwardFlags.Arg(0))
+		if err != nil {
+			fmt.Printf("forward error: %v\n", err)
 			printUsage()
 			os.Exit(1)
 		}
 
-		iphone, err := getDeviceByUDIDOrTakeFirst(deviceUUID)
+		iphone := mustGetDevice()
+
+		forwarder, err := xcdevice.Forward(iphone, net.JoinHostPort(*bind, strconv.Itoa(localPort)), devicePort)
 		if err != nil {
-			fmt.Printf("failed to get device: %v\n", err)
+			fmt.Printf("forward error: %v\n", err)
 			os.Exit(1)
 		}
-		if iphone == nil {
-			fmt.Println("no devices found. is the iphone plugged in?")
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			forwarder.Close()
+		}()
+
+		fmt.Printf("Forwarding %s to device port %d, press Ctrl+C to stop\n", forwarder.Addr(), devicePort)
+
+		if err := forwarder.Serve(); err != nil {
+			forwarder.Close()
+			fmt.Printf("forward error: %v\n", err)
+			os.Exit(1)
+		}
+
+		stats := forwarder.Stats()
+		fmt.Printf("Forwarded %d connections (%d failed), sent %d bytes, received %d bytes\n",
+			stats.Total, stats.Failed, stats.BytesSent, stats.BytesReceived)
+
+		os.Exit(0)
+
+	case "install":
+		installFlags := flag.NewFlagSet("install", flag.ExitOnError)
+		upgrade := installFlags.Bool("upgrade", false, "upgrade the installed application, keeping its data")
+		developer := installFlags.Bool("developer", false, "install with the Developer package type")
+		bundleID := installFlags.String("bundle-id", "", "override the bundle ID sent to the device")
+		metadataPath := installFlags.String("metadata", "", "path to an iTunesMetadata.plist to install with the application")
+		sinfPath := installFlags.String("sinf", "", "path to the application SINF")
+		keepStaged := installFlags.Bool("keep-staged", false, "keep the uploaded package in PublicStaging")
+		installFlags.Parse(flag.Args()[1:])
+
+		if installFlags.Arg(0) == "" {
+			printUsage()
 			os.Exit(1)
 		}
 
-		if err := xcdevice.Install(iphone, flag.Arg(1)); err != nil {
+		opts := &xcdevice.InstallOptions{
+			CFBundleIdentifier: *bundleID,
+			KeepStagedPackage:  *keepStaged,
+		}
+		if *developer {
+			opts.PackageType = xcdevice.PackageTypeDeveloper
+		}
+		if *metadataPath != "" {
+			b, err := os.ReadFile(*metadataPath)
+			if err != nil {
+				fmt.Printf("failed to read metadata: %v\n", err)
+				os.Exit(1)
+			}
+			opts.ITunesMetadata = b
+		}
+		if *sinfPath != "" {
+			b, err := os.ReadFile(*sinfPath)
+			if err != nil {
+				fmt.Printf("failed to read sinf: %v\n", err)
+				os.Exit(1)
+			}
+			opts.ApplicationSINF = b
+		}
+
+		iphone := mustGetDevice()
+
+		var err error
+		if isURL(installFlags.Arg(0)) {
+			var r *infoplist.HTTPReaderAt
+			r, err = infoplist.NewHTTPReaderAt(nil, installFlags.Arg(0))
+			if err == nil {
+				if *upgrade {
+					err = xcdevice.UpgradeFrom(iphone, r, r.Size(), opts, printProgress)
+				} else {
+					err = xcdevice.InstallFrom(iphone, r, r.Size(), opts, printProgress)
+				}
+			}
+		} else if *upgrade {
+			err = xcdevice.Upgrade(iphone, installFlags.Arg(0), opts, printProgress)
+		} else {
+			err = xcdevice.Install(iphone, installFlags.Arg(0), opts, printProgress)
+		}
+		if err != nil {
 			fmt.Printf("installation error: %v\n", err)
 			os.Exit(1)
 		}
 
 		os.Exit(0)
 
+	case "ipa":
+		switch flag.Arg(1) {
+		case "info":
+			infoFlags := flag.NewFlagSet("info", flag.ExitOnError)
+			locale := infoFlags.String("locale", "", "locale of the display name, e.g. fr-CA")
+			infoFlags.Parse(flag.Args()[2:])
+
+			if infoFlags.Arg(0) == "" {
+				printUsage()
+				os.Exit(1)
+			}
+
+			pkg, err := openPackage(infoFlags.Arg(0))
+			if err != nil {
+				fmt.Printf("ipa error: %v\n", err)
+				os.Exit(1)
+			}
+			defer pkg.Close()
+
+			info, err := pkg.LocalizedInfo(*locale)
+			if err != nil {
+				fmt.Printf("ipa error: %v\n", err)
+				os.Exit(1)
+			}
+
+			bundle, err := pkg.Bundles()
+			if err != nil {
+				fmt.Printf("ipa error: %v\n", err)
+				os.Exit(1)
+			}
+
+			if name := info.DisplayName(); name != "" {
+				fmt.Printf("Display name: %s\n", name)
+			}
+			printBundle(bundle, "", "")
+
+		case "icon":
+			iconFlags := flag.NewFlagSet("icon", flag.ExitOnError)
+			size := iconFlags.Int("size", 0, "preferred icon width in pixels, the largest icon is used when 0")
+			output := iconFlags.String("o", "icon.png", "path of the PNG file to write")
+			iconFlags.Parse(flag.Args()[2:])
+
+			if iconFlags.Arg(0) == "" {
+				printUsage()
+				os.Exit(1)
+			}
+
+			pkg, err := openPackage(iconFlags.Arg(0))
+			if err != nil {
+				fmt.Printf("ipa error: %v\n", err)
+				os.Exit(1)
+			}
+			defer pkg.Close()
+
+			img, err := pkg.Icon(*size)
+			if err != nil {
+				fmt.Printf("ipa error: %v\n", err)
+				os.Exit(1)
+			}
+
+			f, err := os.Create(*output)
+			if err != nil {
+				fmt.Printf("ipa error: %v\n", err)
+				os.Exit(1)
+			}
+			if err := png.Encode(f, img); err != nil {
+				f.Close()
+				fmt.Printf("ipa error: %v\n", err)
+				os.Exit(1)
+			}
+			if err := f.Close(); err != nil {
+				fmt.Printf("ipa error: %v\n", err)
+				os.Exit(1)
+			}
+
+		default:
+			printUsage()
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+
 	case "list":
 		devices, err := xcdevice.ListDevices()
 		if err != nil {
@@ -96,57 +528,453 @@ func main() {
 			os.Exit(1)
 		}
 
-		iphone, err := getDeviceByUDIDOrTakeFirst(deviceUUID)
+		iphone := mustGetDevice()
+
+		bundleIDs := flag.Args()[1:]
+
+		apps, err := xcdevice.Lookup(iphone, bundleIDs, xcdevice.DefaultLookupAttributes)
 		if err != nil {
-			fmt.Printf("failed to get device: %v\n", err)
+			fmt.Printf("lookup error: %v\n", err)
 			os.Exit(1)
 		}
-		if iphone == nil {
-			fmt.Println("no devices found. is the iphone plugged in?")
+
+		found := make(map[string]bool, len(apps))
+		for i, app := range apps {
+			if i > 0 {
+				fmt.Println()
+			}
+			printApplication(app)
+			found[app.BundleID] = true
+		}
+
+		exitCode := 0
+		for _, bundleID := range bundleIDs {
+			if !found[bundleID] {
+				fmt.Printf("lookup error: %s is not installed\n", bundleID)
+				exitCode = 1
+			}
+		}
+
+		os.Exit(exitCode)
+
+	case "notify":
+		notifyFlags := flag.NewFlagSet("notify", flag.ExitOnError)
+		insecure := notifyFlags.Bool("insecure", false, "use the insecure notification proxy, which works before activation")
+		if flag.NArg() > 1 {
+			notifyFlags.Parse(flag.Args()[2:])
+		}
+
+		names := notifyFlags.Args()
+		if len(names) == 0 || (flag.Arg(1) != "post" && flag.Arg(1) != "observe") {
+			printUsage()
 			os.Exit(1)
 		}
 
-		info, err := xcdevice.Lookup(iphone, flag.Arg(1), xcdevice.DefaultLookupAttributes)
+		iphone := mustGetDevice()
+
+		post, observe := xcdevice.PostNotification, xcdevice.ObserveNotifications
+		if *insecure {
+			post, observe = xcdevice.PostInsecureNotification, xcdevice.ObserveInsecureNotifications
+		}
+
+		switch flag.Arg(1) {
+		case "post":
+			for _, name := range names {
+				if err := post(iphone, name); err != nil {
+					fmt.Printf("notify error: %v\n", err)
+					os.Exit(1)
+				}
+			}
+
+		case "observe":
+			proxy, err := observe(iphone, names...)
+			if err != nil {
+				fmt.Printf("notify error: %v\n", err)
+				os.Exit(1)
+			}
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-signals
+				proxy.Close()
+			}()
+
+			for name := range proxy.Notifications() {
+				fmt.Printf("%s %s\n", time.Now().Format(time.RFC3339), name)
+			}
+			// the proxy is already closed when interrupted, Close only
+			// releases the connection if the device ended it
+			proxy.Close()
+			if err := proxy.Err(); err != nil {
+				fmt.Printf("notify error: %v\n", err)
+				os.Exit(1)
+			}
+
+		default:
+			printUsage()
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+
+	case "oslog":
+		if flag.Arg(1) == "archive" {
+			archiveFlags := flag.NewFlagSet("archive", flag.ExitOnError)
+			output := archiveFlags.String("o", "system_logs.tar", "path of the tarball to write")
+			sizeLimit := archiveFlags.Int64("size-limit", 0, "maximum size of the archive in bytes")
+			ageLimit := archiveFlags.Duration("age-limit", 0, "maximum age of the archived entries, e.g. 1h")
+			archiveFlags.Parse(flag.Args()[2:])
+
+			iphone := mustGetDevice()
+
+			f, err := os.Create(*output)
+			if err != nil {
+				fmt.Printf("oslog error: %v\n", err)
+				os.Exit(1)
+			}
+
+			opts := &xcdevice.LogArchiveOptions{
+				SizeLimit: *sizeLimit,
+				AgeLimit:  int64(ageLimit.Seconds()),
+			}
+			if err := xcdevice.CreateLogArchive(iphone, f, opts); err != nil {
+				f.Close()
+				os.Remove(*output)
+				fmt.Printf("oslog error: %v\n", err)
+				os.Exit(1)
+			}
+			if err := f.Close(); err != nil {
+				fmt.Printf("oslog error: %v\n", err)
+				os.Exit(1)
+			}
+
+			os.Exit(0)
+		}
+
+		oslogFlags := flag.NewFlagSet("oslog", flag.ExitOnError)
+		pid := oslogFlags.Int("pid", -1, "only stream entries of this process ID")
+		process := oslogFlags.String("process", "", "only show entries logged by this process")
+		subsystem := oslogFlags.String("subsystem", "", "only show entries of this subsystem")
+		category := oslogFlags.String("category", "", "only show entries of this category")
+		jsonOutput := oslogFlags.Bool("json", false, "print one JSON object per entry")
+		oslogFlags.Parse(flag.Args()[1:])
+
+		iphone := mustGetDevice()
+
+		relay, err := xcdevice.OSLog(iphone, *pid)
 		if err != nil {
-			fmt.Printf("lookup error: %v\n", err)
+			fmt.Printf("oslog error: %v\n", err)
 			os.Exit(1)
 		}
+		defer relay.Close()
 
-		for k, v := range info {
-			fmt.Printf("%s: %v\n", k, v)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+		// entries are read in the background, so that an interrupt returns
+		// and closes the relay while Next is blocked
+		entries := make(chan *xcdevice.OSLogEntry)
+		errs := make(chan error, 1)
+		go func() {
+			for {
+				entry, err := relay.Next()
+				if err != nil {
+					errs <- err
+					return
+				}
+				entries <- entry
+			}
+		}()
+
+		enc := json.NewEncoder(os.Stdout)
+		for {
+			var entry *xcdevice.OSLogEntry
+			select {
+			case <-signals:
+				return
+			case err := <-errs:
+				fmt.Printf("oslog error: %v\n", err)
+				os.Exit(1)
+			case entry = <-entries:
+			}
+
+			if *process != "" && entry.Process() != *process {
+				continue
+			}
+			if *subsystem != "" && entry.Subsystem != *subsystem {
+				continue
+			}
+			if *category != "" && entry.Category != *category {
+				continue
+			}
+
+			if *jsonOutput {
+				enc.Encode(entry)
+			} else {
+				fmt.Println(entry)
+			}
 		}
 
+	case "ps":
+		psFlags := flag.NewFlagSet("ps", flag.ExitOnError)
+		asJSON := psFlags.Bool("json", false, "print processes as JSON")
+		psFlags.Parse(flag.Args()[1:])
+
+		iphone := mustGetDevice()
+
+		processes, err := xcdevice.ProcessList(iphone)
+		if err != nil {
+			fmt.Printf("ps error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(processes); err != nil {
+				fmt.Printf("failed to encode processes: %v\n", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PID\tNAME")
+		for _, p := range processes {
+			fmt.Fprintf(w, "%d\t%s\n", p.PID, p.Name)
+		}
+		w.Flush()
+
 		os.Exit(0)
 
-	case "uninstall":
-		if flag.Arg(1) == "" {
+	case "reboot":
+		iphone := mustGetDevice()
+
+		if err := xcdevice.RestartDevice(iphone); err != nil {
+			fmt.Printf("reboot error: %v\n", err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+
+	case "resign":
+		resignFlags := flag.NewFlagSet("resign", flag.ExitOnError)
+		p12Path := resignFlags.String("p12", "", "path to the signing certificate and private key")
+		password := resignFlags.String("password", "", "password of the p12 file")
+		profilePath := resignFlags.String("profile", "", "path to the provisioning profile of the application")
+		bundleProfiles := keyValueFlag{}
+		resignFlags.Var(bundleProfiles, "bundle-profile", "provisioning profile of a nested bundle as bundleID=path, may be repeated")
+		output := resignFlags.String("o", "", "path of the re-signed IPA")
+		resignFlags.Parse(flag.Args()[1:])
+
+		if resignFlags.Arg(0) == "" || *p12Path == "" || *profilePath == "" || *output == "" {
 			printUsage()
 			os.Exit(1)
 		}
 
-		iphone, err := getDeviceByUDIDOrTakeFirst(deviceUUID)
+		p12, err := os.ReadFile(*p12Path)
+		if err != nil {
+			fmt.Printf("resign error: %v\n", err)
+			os.Exit(1)
+		}
+
+		identity, err := codesign.LoadP12(p12, *password)
 		if err != nil {
-			fmt.Printf("failed to get device: %v\n", err)
+			fmt.Printf("resign error: %v\n", err)
+			os.Exit(1)
+		}
+
+		opts := &codesign.Options{
+			Identity:       identity,
+			BundleProfiles: make(map[string][]byte, len(bundleProfiles)),
+		}
+
+		opts.Profile, err = os.ReadFile(*profilePath)
+		if err != nil {
+			fmt.Printf("resign error: %v\n", err)
+			os.Exit(1)
+		}
+
+		for bundleID, p := range bundleProfiles {
+			b, err := os.ReadFile(p)
+			if err != nil {
+				fmt.Printf("resign error: %v\n", err)
+				os.Exit(1)
+			}
+			opts.BundleProfiles[bundleID] = b
+		}
+
+		if err := codesign.ResignFile(*output, resignFlags.Arg(0), opts); err != nil {
+			fmt.Printf("resign error: %v\n", err)
 			os.Exit(1)
 		}
-		if iphone == nil {
-			fmt.Println("no devices found. is the iphone plugged in?")
+
+		os.Exit(0)
+
+	case "screenshot":
+		screenshotFlags := flag.NewFlagSet("screenshot", flag.ExitOnError)
+		output := screenshotFlags.String("o", "screenshot.png", "path of the PNG file to write")
+		screenshotFlags.Parse(flag.Args()[1:])
+
+		iphone := mustGetDevice()
+
+		data, err := xcdevice.Screenshot(iphone)
+		if err != nil {
+			fmt.Printf("screenshot error: %v\n", err)
 			os.Exit(1)
 		}
 
-		if err := xcdevice.Uninstall(iphone, flag.Arg(1)); err != nil {
+		if err := os.WriteFile(*output, data, 0644); err != nil {
+			fmt.Printf("screenshot error: %v\n", err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+
+	case "staging":
+		if flag.Arg(1) != "clean" {
+			printUsage()
+			os.Exit(1)
+		}
+
+		iphone := mustGetDevice()
+
+		if err := xcdevice.CleanStaging(iphone); err != nil {
+			fmt.Printf("staging error: %v\n", err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+
+	case "syslog":
+		syslogFlags := flag.NewFlagSet("syslog", flag.ExitOnError)
+		process := syslogFlags.String("process", "", "only show lines logged by this process")
+		match := syslogFlags.String("match", "", "only show lines whose message matches this regular expression")
+		jsonOutput := syslogFlags.Bool("json", false, "print one JSON object per line")
+		syslogFlags.Parse(flag.Args()[1:])
+
+		var pattern *regexp.Regexp
+		if *match != "" {
+			var err error
+			pattern, err = regexp.Compile(*match)
+			if err != nil {
+				fmt.Printf("invalid --match: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		iphone := mustGetDevice()
+
+		relay, err := xcdevice.Syslog(iphone)
+		if err != nil {
+			fmt.Printf("syslog error: %v\n", err)
+			os.Exit(1)
+		}
+		defer relay.Close()
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+		// lines are read in the background, so that an interrupt returns
+		// and closes the relay while Next is blocked
+		lines := make(chan *xcdevice.SyslogLine)
+		errs := make(chan error, 1)
+		go func() {
+			for {
+				line, err := relay.Next()
+				if err != nil {
+					errs <- err
+					return
+				}
+				lines <- line
+			}
+		}()
+
+		enc := json.NewEncoder(os.Stdout)
+		for {
+			var line *xcdevice.SyslogLine
+			select {
+			case <-signals:
+				return
+			case err := <-errs:
+				fmt.Printf("syslog error: %v\n", err)
+				os.Exit(1)
+			case line = <-lines:
+			}
+
+			if *process != "" && line.Process != *process {
+				continue
+			}
+			if pattern != nil && !pattern.MatchString(line.Message) {
+				continue
+			}
+
+			if *jsonOutput {
+				enc.Encode(line)
+			} else {
+				fmt.Println(line)
+			}
+		}
+
+	case "uninstall":
+		if flag.Arg(1) == "" {
+			printUsage()
+			os.Exit(1)
+		}
+
+		iphone := mustGetDevice()
+
+		if err := xcdevice.Uninstall(iphone, flag.Arg(1), printProgress); err != nil {
 			fmt.Printf("uninstallation error: %v\n", err)
 			os.Exit(1)
 		}
 
 		os.Exit(0)
 
+	case "verify":
+		if flag.Arg(1) == "" {
+			printUsage()
+			os.Exit(1)
+		}
+
+		if err := infoplist.Verify(flag.Arg(1)); err != nil {
+			var verr *infoplist.VerificationError
+			if errors.As(err, &verr) {
+				for _, p := range verr.Problems {
+					fmt.Println(p)
+				}
+				os.Exit(1)
+			}
+			fmt.Printf("verification error: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("ok")
+
+		os.Exit(0)
+
 	default:
 		printUsage()
 		os.Exit(1)
 	}
 }
 
+// mustGetDevice returns the device selected with the --device flag or the
+// first USB device, and exits if there is none.
+func mustGetDevice() *xcdevice.Device {
+	iphone, err := getDeviceByUDIDOrTakeFirst(deviceUUID)
+	if err != nil {
+		fmt.Printf("failed to get device: %v\n", err)
+		os.Exit(1)
+	}
+	if iphone == nil {
+		fmt.Println("no devices found. is the iphone plugged in?")
+		os.Exit(1)
+	}
+	return iphone
+}
+
 func getDeviceByUDIDOrTakeFirst(udid string) (*xcdevice.Device, error) {
 	devices, err := xcdevice.ListDevices()
 	if err != nil {
@@ -167,3 +995,140 @@ func getDeviceByUDIDOrTakeFirst(udid string) (*xcdevice.Device, error) {
 
 	return nil, nil
 }
+
+// keyValueFlag collects repeated key=value flags.
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f keyValueFlag) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	f[k] = v
+	return nil
+}
+
+// parsePortMapping parses "localport:deviceport", or a single port which is
+// used for both.
+func parsePortMapping(s string) (int, int, error) {
+	if s == "" {
+		return 0, 0, errors.New("missing port")
+	}
+
+	local, device := s, s
+	if i := strings.Index(s, ":"); i >= 0 {
+		local, device = s[:i], s[i+1:]
+	}
+
+	localPort, err := strconv.Atoi(local)
+	if err != nil || localPort < 0 || localPort > 0xffff {
+		return 0, 0, fmt.Errorf("invalid local port %q", local)
+	}
+	devicePort, err := strconv.Atoi(device)
+	if err != nil || devicePort <= 0 || devicePort > 0xffff {
+		return 0, 0, fmt.Errorf("invalid device port %q", device)
+	}
+
+	return localPort, devicePort, nil
+}
+
+// isURL reports whether name refers to a remote IPA rather than a local file.
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// openPackage opens a local IPA or .app directory, or a remote IPA using
+// range requests.
+func openPackage(name string) (*infoplist.Package, error) {
+	if !isURL(name) {
+		return infoplist.Open(name)
+	}
+
+	r, err := infoplist.NewHTTPReaderAt(nil, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return infoplist.NewReader(r, r.Size())
+}
+
+// printApplication prints the application attributes in a stable order,
+// followed by any extra attributes sorted by name.
+func printApplication(app xcdevice.Application) {
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"CFBundleIdentifier", app.BundleID},
+		{"CFBundleDisplayName", app.DisplayName},
+		{"CFBundleName", app.Name},
+		{"CFBundleExecutable", app.Executable},
+		{"CFBundleShortVersionString", app.ShortVersion},
+		{"CFBundleVersion", app.Version},
+		{"ApplicationType", string(app.ApplicationType)},
+		{"Path", app.Path},
+		{"Container", app.Container},
+		{"SignerIdentity", app.SignerIdentity},
+	}
+	for _, f := range fields {
+		if f.value != "" {
+			fmt.Printf("%s: %s\n", f.name, f.value)
+		}
+	}
+
+	if len(app.Entitlements) > 0 {
+		fmt.Println("Entitlements:")
+		for _, k := range sortedKeys(app.Entitlements) {
+			fmt.Printf("  %s: %v\n", k, app.Entitlements[k])
+		}
+	}
+
+	for _, k := range sortedKeys(app.Extras) {
+		fmt.Printf("%s: %v\n", k, app.Extras[k])
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// printBundle prints the bundle and the bundles nested in it as a tree.
+func printBundle(b *infoplist.Bundle, parent, indent string) {
+	name := strings.TrimPrefix(b.Path, parent+"/")
+	bundleID, _ := b.Info[infoplist.PlistKeyBundleIdentifier].(string)
+	version, _ := b.Info[infoplist.PlistKeyBundleShortVersionString].(string)
+	build, _ := b.Info[infoplist.PlistKeyBundleVersion].(string)
+
+	line := indent + name
+	if bundleID != "" {
+		line += "  " + bundleID
+	}
+	if version != "" {
+		line += fmt.Sprintf("  %s (%s)", version, build)
+	}
+	fmt.Println(line)
+
+	for _, nested := range b.Bundles {
+		printBundle(nested, b.Path, indent+"  ")
+	}
+}
+
+// printProgress prints the current phase of a long running operation, so
+// that slow installs do not look like they are stuck.
+func printProgress(status string, percent int) {
+	fmt.Printf("%3d%% %s\n", percent, status)
+}
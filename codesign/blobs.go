@@ -0,0 +1,319 @@
+package codesign
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/romantomjak/xcdevice/internal/codesig"
+	"howett.net/plist"
+)
+
+const (
+	// csCodeDirectoryVersion is the code directory version which adds the
+	// executable segment fields.
+	csCodeDirectoryVersion = 0x20400
+
+	// csCodeDirectoryHeaderSize is the size of a version 0x20400 code
+	// directory without the identifiers and hashes.
+	csCodeDirectoryHeaderSize = 88
+
+	csHashTypeSHA256 = 2
+
+	// csPageShift is the log2 of the size of the pages that are hashed.
+	csPageShift = 12
+	csPageSize  = 1 << csPageShift
+)
+
+// Executable segment flags.
+const (
+	csExecSegMainBinary    = 0x1
+	csExecSegAllowUnsigned = 0x10
+)
+
+// Requirement language opcodes and match operations.
+const (
+	reqKindExpression = 1
+	reqTypeDesignated = 3
+
+	opIdent              = 2
+	opAnd                = 6
+	opCertField          = 11
+	opCertGeneric        = 14
+	opAppleGenericAnchor = 15
+
+	matchExists = 0
+	matchEqual  = 1
+)
+
+// oidAppleWWDRIntermediate is the DER encoded 1.2.840.113635.100.6.2.1
+// certificate extension identifying the Apple Worldwide Developer Relations
+// intermediate certificate.
+var oidAppleWWDRIntermediate = []byte{0x2a, 0x86, 0x48, 0x86, 0xf7, 0x63, 0x64, 0x06, 0x02, 0x01}
+
+// blob prefixes data with the magic and length header every signature blob
+// starts with.
+func blob(magic uint32, data []byte) []byte {
+	b := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(b, magic)
+	binary.BigEndian.PutUint32(b[4:], uint32(8+len(data)))
+	return append(b, data...)
+}
+
+// superBlob combines blobs, keyed by their slot, into an embedded signature.
+func superBlob(blobs map[uint32][]byte) []byte {
+	slots := make([]uint32, 0, len(blobs))
+	for slot := range blobs {
+		slots = append(slots, slot)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+
+	header := make([]byte, 4+8*len(slots))
+	binary.BigEndian.PutUint32(header, uint32(len(slots)))
+
+	offset := 8 + len(header)
+	data := &bytes.Buffer{}
+	for i, slot := range slots {
+		binary.BigEndian.PutUint32(header[4+8*i:], slot)
+		binary.BigEndian.PutUint32(header[8+8*i:], uint32(offset+data.Len()))
+		data.Write(blobs[slot])
+	}
+
+	return blob(codesig.MagicEmbeddedSignature, append(header, data.Bytes()...))
+}
+
+// codeDirectory describes the code directory of a single Mach-O slice.
+type codeDirectory struct {
+	identifier string
+	teamID     string
+
+	// specialSlots holds the hashes of the special slots, indexed by slot
+	// number. Index 0 is unused.
+	specialSlots [][]byte
+
+	// codeLimit is the offset of the code signature, everything before it
+	// is hashed.
+	codeLimit uint32
+
+	execSegBase  uint64
+	execSegLimit uint64
+	execSegFlags uint64
+}
+
+// size returns the length of the code directory blob.
+func (cd *codeDirectory) size() int {
+	nCodeSlots := (int(cd.codeLimit) + csPageSize - 1) / csPageSize
+	nSpecialSlots := len(cd.specialSlots) - 1
+	return csCodeDirectoryHeaderSize +
+		len(cd.identifier) + 1 + len(cd.teamID) + 1 +
+		(nSpecialSlots+nCodeSlots)*sha256.Size
+}
+
+// encode returns the code directory blob for the code, which must be
+// codeLimit bytes long.
+func (cd *codeDirectory) encode(code []byte) []byte {
+	nCodeSlots := (len(code) + csPageSize - 1) / csPageSize
+	nSpecialSlots := len(cd.specialSlots) - 1
+
+	identOffset := csCodeDirectoryHeaderSize
+	teamOffset := identOffset + len(cd.identifier) + 1
+	hashOffset := teamOffset + len(cd.teamID) + 1 + nSpecialSlots*sha256.Size
+
+	b := make([]byte, cd.size())
+	be := binary.BigEndian
+	be.PutUint32(b[0:], codesig.MagicCodeDirectory)
+	be.PutUint32(b[4:], uint32(len(b)))
+	be.PutUint32(b[8:], csCodeDirectoryVersion)
+	be.PutUint32(b[12:], 0) // flags
+	be.PutUint32(b[16:], uint32(hashOffset))
+	be.PutUint32(b[20:], uint32(identOffset))
+	be.PutUint32(b[24:], uint32(nSpecialSlots))
+	be.PutUint32(b[28:], uint32(nCodeSlots))
+	be.PutUint32(b[32:], cd.codeLimit)
+	b[36] = sha256.Size
+	b[37] = csHashTypeSHA256
+	b[38] = 0 // platform
+	b[39] = csPageShift
+	// spare2, scatterOffset
+	be.PutUint32(b[48:], uint32(teamOffset))
+	// spare3, codeLimit64
+	be.PutUint64(b[64:], cd.execSegBase)
+	be.PutUint64(b[72:], cd.execSegLimit)
+	be.PutUint64(b[80:], cd.execSegFlags)
+
+	copy(b[identOffset:], cd.identifier)
+	copy(b[teamOffset:], cd.teamID)
+
+	// special slots are stored in reverse order before the code slots
+	for slot := 1; slot <= nSpecialSlots; slot++ {
+		copy(b[hashOffset-slot*sha256.Size:], cd.specialSlots[slot])
+	}
+
+	for i := 0; i < nCodeSlots; i++ {
+		end := (i + 1) * csPageSize
+		if end > len(code) {
+			end = len(code)
+		}
+		h := sha256.Sum256(code[i*csPageSize : end])
+		copy(b[hashOffset+i*sha256.Size:], h[:])
+	}
+
+	return b
+}
+
+// designatedRequirement returns the designated requirement of code signed
+// with a development or distribution certificate issued by Apple, both in
+// the requirement language and as a compiled requirements blob:
+//
+//	identifier "com.example.app" and anchor apple generic and
+//	certificate leaf[subject.CN] = "Apple Distribution: Example (ABCDE12345)" and
+//	certificate 1[field.1.2.840.113635.100.6.2.1] /* exists */
+func designatedRequirement(identifier, commonName string) (string, []byte) {
+	text := fmt.Sprintf(`identifier %s and anchor apple generic and certificate leaf[subject.CN] = %s and certificate 1[field.1.2.840.113635.100.6.2.1] /* exists */`,
+		quoteRequirement(identifier), quoteRequirement(commonName))
+
+	expr := &bytes.Buffer{}
+	op := func(values ...uint32) {
+		for _, v := range values {
+			binary.Write(expr, binary.BigEndian, v)
+		}
+	}
+	data := func(b []byte) {
+		op(uint32(len(b)))
+		expr.Write(b)
+		expr.Write(make([]byte, (4-len(b)%4)%4))
+	}
+
+	// the and operator is binary, codesign nests them to the left
+	op(opAnd, opAnd, opAnd)
+	op(opIdent)
+	data([]byte(identifier))
+	op(opAppleGenericAnchor)
+	op(opCertField, 0)
+	data([]byte("subject.CN"))
+	op(matchEqual)
+	data([]byte(commonName))
+	op(opCertGeneric, 1)
+	data(oidAppleWWDRIntermediate)
+	op(matchExists)
+
+	requirement := blob(codesig.MagicRequirement, append([]byte{0, 0, 0, reqKindExpression}, expr.Bytes()...))
+
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint32(header, 1)
+	binary.BigEndian.PutUint32(header[4:], reqTypeDesignated)
+	binary.BigEndian.PutUint32(header[8:], 20)
+
+	return text, blob(codesig.MagicRequirements, append(header, requirement...))
+}
+
+func quoteRequirement(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// entitlementsBlob returns the entitlements as an XML plist blob.
+func entitlementsBlob(entitlements map[string]interface{}) ([]byte, error) {
+	data, err := plist.MarshalIndent(entitlements, plist.XMLFormat, "\t")
+	if err != nil {
+		return nil, err
+	}
+	return blob(codesig.MagicEmbeddedEntitlements, data), nil
+}
+
+// entitlementsDERBlob returns the entitlements in the DER encoding iOS 15
+// and later require:
+//
+//	[APPLICATION 16] {
+//	  INTEGER 1,
+//	  [CONTEXT 16] { SEQUENCE { UTF8String key, value }, ... } }
+//
+// Dictionaries are encoded as a [CONTEXT 16] set of key/value sequences
+// sorted by key, arrays as sequences.
+func entitlementsDERBlob(entitlements map[string]interface{}) ([]byte, error) {
+	dict, err := derEntitlementValue(entitlements)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := asn1.Marshal(1)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassApplication,
+		Tag:        16,
+		IsCompound: true,
+		Bytes:      append(version, dict...),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return blob(codesig.MagicEntitlementsDER, der), nil
+}
+
+func derEntitlementValue(v interface{}) ([]byte, error) {
+	switch value := v.(type) {
+	case bool:
+		return asn1.Marshal(value)
+	case string:
+		return asn1.Marshal(asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte(value)})
+	case uint64:
+		return asn1.Marshal(new(big.Int).SetUint64(value))
+	case int64:
+		return asn1.Marshal(value)
+	case int:
+		return asn1.Marshal(value)
+
+	case []interface{}:
+		items := make([]byte, 0)
+		for _, item := range value {
+			b, err := derEntitlementValue(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, b...)
+		}
+		return asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: items})
+
+	case []string:
+		items := make([]interface{}, 0, len(value))
+		for _, s := range value {
+			items = append(items, s)
+		}
+		return derEntitlementValue(items)
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		entries := make([]byte, 0)
+		for _, k := range keys {
+			key, err := derEntitlementValue(k)
+			if err != nil {
+				return nil, err
+			}
+			val, err := derEntitlementValue(value[k])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", k, err)
+			}
+			entry, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: append(key, val...)})
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry...)
+		}
+		return asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 16, IsCompound: true, Bytes: entries})
+	}
+
+	return nil, fmt.Errorf("unsupported entitlement value of type %T", v)
+}
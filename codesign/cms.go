@@ -0,0 +1,180 @@
+package codesign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/romantomjak/xcdevice/internal/codesig"
+	"howett.net/plist"
+)
+
+var (
+	oidData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+	// oidAppleHashAgility holds a plist listing the truncated hashes of all
+	// code directories, oidAppleHashAgilityV2 the full hashes.
+	oidAppleHashAgility   = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 9, 1}
+	oidAppleHashAgilityV2 = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 9, 2}
+)
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      []signerInfo `asn1:"set"`
+}
+
+// encapContentInfo has no content, the code directory is detached.
+type encapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+}
+
+type signerInfo struct {
+	Version            int
+	IssuerAndSerial    issuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type hashAgilityV2 struct {
+	Algorithm asn1.ObjectIdentifier
+	Digest    []byte
+}
+
+// signatureBlob returns the CMS blob with a detached signature of the code
+// directory, in the form codesign produces.
+func signatureBlob(identity *Identity, codeDirectory []byte, signingTime time.Time) ([]byte, error) {
+	digest := sha256.Sum256(codeDirectory)
+
+	cdhashes, err := plist.MarshalIndent(map[string]interface{}{
+		"cdhashes": [][]byte{digest[:20]},
+	}, plist.XMLFormat, "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make([][]byte, 0, 5)
+	for _, a := range []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidContentType, oidData},
+		{oidSigningTime, signingTime.UTC()},
+		{oidMessageDigest, digest[:]},
+		{oidAppleHashAgility, cdhashes},
+		{oidAppleHashAgilityV2, hashAgilityV2{oidSHA256, digest[:]}},
+	} {
+		value, err := asn1.Marshal(a.value)
+		if err != nil {
+			return nil, err
+		}
+		attr, err := asn1.Marshal(attribute{a.oid, []asn1.RawValue{{FullBytes: value}}})
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+
+	// DER sorts the elements of a SET OF by their encoding. The signature
+	// covers the attributes encoded as a SET, but they are stored with an
+	// implicit [0] tag.
+	sort.Slice(attrs, func(i, j int) bool { return bytes.Compare(attrs[i], attrs[j]) < 0 })
+	attrsContent := bytes.Join(attrs, nil)
+
+	signedAttrs, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: attrsContent})
+	if err != nil {
+		return nil, err
+	}
+	attrsDigest := sha256.Sum256(signedAttrs)
+
+	var signatureAlgorithm pkix.AlgorithmIdentifier
+	switch identity.PrivateKey.Public().(type) {
+	case *rsa.PublicKey:
+		signatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		signatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", identity.PrivateKey)
+	}
+
+	signature, err := identity.PrivateKey.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := make([]byte, 0)
+	for _, cert := range append([]*x509.Certificate{identity.Certificate}, identity.Chain...) {
+		certs = append(certs, cert.Raw...)
+	}
+
+	digestAlgorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlgorithm},
+		EncapContentInfo: encapContentInfo{oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			IssuerAndSerial: issuerAndSerial{
+				Issuer: asn1.RawValue{FullBytes: identity.Certificate.RawIssuer},
+				Serial: identity.Certificate.SerialNumber,
+			},
+			DigestAlgorithm:    digestAlgorithm,
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrsContent},
+			SignatureAlgorithm: signatureAlgorithm,
+			Signature:          signature,
+		}},
+	}
+
+	content, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return blob(codesig.MagicBlobWrapper, der), nil
+}
@@ -0,0 +1,495 @@
+// Package codesign re-signs iOS applications without the macOS codesign tool.
+//
+// Signatures use a single SHA-256 code directory, which is supported from
+// iOS 11 onwards, together with the DER entitlements iOS 15 requires.
+package codesign
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/romantomjak/xcdevice/infoplist"
+	"golang.org/x/crypto/pkcs12"
+)
+
+var (
+	// ErrCertificateNotInProfile is returned by Resign when the signing
+	// certificate is not one of the developer certificates of a
+	// provisioning profile.
+	ErrCertificateNotInProfile = errors.New("signing certificate is not included in the provisioning profile")
+
+	// ErrEncrypted is returned for executables encrypted by the App Store,
+	// which can not run with a different signature.
+	ErrEncrypted = errors.New("executable is encrypted")
+
+	// ErrNotSigned is returned for executables without a code signature.
+	ErrNotSigned = errors.New("executable is not signed")
+)
+
+// Identity is a signing certificate together with its private key.
+type Identity struct {
+	Certificate *x509.Certificate
+
+	// Chain holds the intermediate certificates, usually the Apple
+	// Worldwide Developer Relations certificate. They are included in the
+	// signature.
+	Chain []*x509.Certificate
+
+	PrivateKey crypto.Signer
+}
+
+// LoadP12 reads a signing identity exported from Keychain Access.
+//
+// Only the legacy PKCS#12 encryption schemes are supported. Files exported
+// with OpenSSL 3 have to be exported with the -legacy flag.
+func LoadP12(data []byte, password string) (*Identity, error) {
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("p12: %v", err)
+	}
+
+	identity := &Identity{}
+	certs := make([]*x509.Certificate, 0)
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("p12: %v", err)
+			}
+			certs = append(certs, cert)
+
+		case "PRIVATE KEY":
+			// pkcs12 converts the keys to PKCS#1 and SEC 1 rather than
+			// PKCS#8
+			if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+				identity.PrivateKey = key
+			} else if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+				identity.PrivateKey = key
+			} else {
+				return nil, fmt.Errorf("p12: unsupported private key")
+			}
+		}
+	}
+
+	if identity.PrivateKey == nil {
+		return nil, fmt.Errorf("p12: missing private key")
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(identity.PrivateKey.Public())
+	if err != nil {
+		return nil, fmt.Errorf("p12: %v", err)
+	}
+	for _, cert := range certs {
+		if identity.Certificate == nil && bytes.Equal(cert.RawSubjectPublicKeyInfo, publicKey) {
+			identity.Certificate = cert
+		} else {
+			identity.Chain = append(identity.Chain, cert)
+		}
+	}
+
+	if identity.Certificate == nil {
+		return nil, fmt.Errorf("p12: missing certificate for the private key")
+	}
+
+	return identity, nil
+}
+
+// TeamID returns the team identifier of the certificate, which Apple stores
+// in the organizational unit of the subject.
+func (id *Identity) TeamID() string {
+	if len(id.Certificate.Subject.OrganizationalUnit) == 0 {
+		return ""
+	}
+	return id.Certificate.Subject.OrganizationalUnit[0]
+}
+
+// Options configure Resign.
+type Options struct {
+	Identity *Identity
+
+	// Profile is the contents of the .mobileprovision embedded in the
+	// application and, unless they are listed in BundleProfiles, its app
+	// extensions and watch apps.
+	Profile []byte
+
+	// BundleProfiles holds the provisioning profiles of nested bundles,
+	// keyed by bundle ID.
+	BundleProfiles map[string][]byte
+}
+
+// ResignFile re-signs the IPA at src and writes the result to dst.
+func ResignFile(dst, src string, opts *Options) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if err := Resign(out, in, fi.Size(), opts); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+
+	return out.Close()
+}
+
+// Resign re-signs the IPA read from r, which is size bytes long, and writes
+// the result to w.
+//
+// The embedded.mobileprovision of the application and its extensions is
+// replaced and their entitlements are taken from the profiles, with wildcard
+// application identifiers resolved to the bundle ID. Nested bundles are
+// signed before the bundles containing them, each getting a new code
+// signature and _CodeSignature/CodeResources.
+func Resign(w io.Writer, r io.ReaderAt, size int64, opts *Options) error {
+	if opts == nil || opts.Identity == nil {
+		return fmt.Errorf("missing signing identity")
+	}
+	if opts.Profile == nil {
+		return fmt.Errorf("missing provisioning profile")
+	}
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	pkg, err := infoplist.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	root, err := pkg.Bundles()
+	if err != nil {
+		return err
+	}
+
+	s := &signer{
+		opts:        opts,
+		files:       make(map[string]*zip.File, len(zr.File)),
+		modified:    make(map[string][]byte),
+		signingTime: time.Now(),
+	}
+	for _, f := range zr.File {
+		if !strings.HasSuffix(f.Name, "/") {
+			s.files[f.Name] = f
+		}
+	}
+
+	if _, _, err := s.signBundle(root); err != nil {
+		return err
+	}
+
+	return s.write(w, zr)
+}
+
+type signer struct {
+	opts *Options
+
+	// files holds the regular files and symlinks of the IPA, modified the
+	// ones that were changed or added while signing.
+	files    map[string]*zip.File
+	modified map[string][]byte
+
+	signingTime time.Time
+}
+
+// signBundle signs the nested bundles and loose libraries of b, then b
+// itself. It returns the cdhash and designated requirement of the bundle.
+func (s *signer) signBundle(b *infoplist.Bundle) ([]byte, string, error) {
+	nested := make(map[string]nestedCode)
+	for _, n := range b.Bundles {
+		cdhash, requirement, err := s.signBundle(n)
+		if err != nil {
+			return nil, "", err
+		}
+		nested[strings.TrimPrefix(n.Path, b.Path+"/")] = nestedCode{cdhash, requirement}
+	}
+
+	bundleID, _ := b.Info[infoplist.PlistKeyBundleIdentifier].(string)
+	executable, _ := b.Info[infoplist.PlistKeyBundleExecutable].(string)
+	if bundleID == "" || executable == "" {
+		return nil, "", fmt.Errorf("%s: missing %s or %s", b.Path, infoplist.PlistKeyBundleIdentifier, infoplist.PlistKeyBundleExecutable)
+	}
+
+	libraries, err := s.glob(path.Join(b.Path, "Frameworks", "*.dylib"))
+	if err != nil {
+		return nil, "", err
+	}
+	for _, lib := range libraries {
+		identifier := strings.TrimSuffix(path.Base(lib), ".dylib")
+		_, requirements := designatedRequirement(identifier, s.opts.Identity.Certificate.Subject.CommonName)
+		if err := s.signExecutable(lib, &signingInfo{
+			identifier:   identifier,
+			teamID:       s.opts.Identity.TeamID(),
+			requirements: requirements,
+		}); err != nil {
+			return nil, "", err
+		}
+	}
+
+	var entitlements map[string]interface{}
+	if path.Ext(b.Path) != ".framework" {
+		profileData := s.opts.Profile
+		if p, ok := s.opts.BundleProfiles[bundleID]; ok {
+			profileData = p
+		}
+
+		entitlements, err = s.entitlements(profileData, bundleID)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", b.Path, err)
+		}
+		s.modified[path.Join(b.Path, "embedded.mobileprovision")] = profileData
+	}
+
+	executablePath := path.Join(b.Path, executable)
+	resources := make([]resource, 0)
+	for _, name := range s.names() {
+		if !strings.HasPrefix(name, b.Path+"/") || name == executablePath {
+			continue
+		}
+		rel := strings.TrimPrefix(name, b.Path+"/")
+		if strings.HasPrefix(rel, "_CodeSignature/") {
+			continue
+		}
+
+		r := resource{name: rel}
+		data, symlink, err := s.read(name)
+		if err != nil {
+			return nil, "", err
+		}
+		if symlink {
+			r.symlink = string(data)
+		} else {
+			r.data = data
+		}
+		resources = append(resources, r)
+	}
+
+	resourcesData, err := codeResources(resources, nested)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", b.Path, err)
+	}
+	s.modified[path.Join(b.Path, "_CodeSignature", "CodeResources")] = resourcesData
+
+	info, _, err := s.read(path.Join(b.Path, "Info.plist"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	requirement, requirements := designatedRequirement(bundleID, s.opts.Identity.Certificate.Subject.CommonName)
+	si := &signingInfo{
+		identifier:    bundleID,
+		teamID:        s.opts.Identity.TeamID(),
+		info:          info,
+		codeResources: resourcesData,
+		entitlements:  entitlements,
+		requirements:  requirements,
+	}
+
+	data, _, err := s.read(executablePath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	signed, cdhash, err := signMachO(data, si, s.opts.Identity, s.signingTime)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", executablePath, err)
+	}
+	s.modified[executablePath] = signed
+
+	return cdhash, requirement, nil
+}
+
+func (s *signer) signExecutable(name string, si *signingInfo) error {
+	data, _, err := s.read(name)
+	if err != nil {
+		return err
+	}
+
+	signed, _, err := signMachO(data, si, s.opts.Identity, s.signingTime)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	s.modified[name] = signed
+
+	return nil
+}
+
+// entitlements returns the entitlements granted by the profile to the
+// bundle and checks that the profile can be used to sign it.
+func (s *signer) entitlements(data []byte, bundleID string) (map[string]interface{}, error) {
+	profile, err := infoplist.ParseProvisioningProfile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	included := false
+	for _, cert := range profile.DeveloperCertificates {
+		if bytes.Equal(cert, s.opts.Identity.Certificate.Raw) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return nil, fmt.Errorf("%w: %q", ErrCertificateNotInProfile, profile.Name)
+	}
+
+	entitlements := make(map[string]interface{}, len(profile.Entitlements))
+	for k, v := range profile.Entitlements {
+		entitlements[k] = v
+	}
+
+	appID := profile.AppID()
+	if appID == "" || len(profile.ApplicationIdentifierPrefix) == 0 {
+		return entitlements, nil
+	}
+
+	prefix := profile.ApplicationIdentifierPrefix[0] + "."
+	pattern := strings.TrimPrefix(appID, prefix)
+	switch {
+	case pattern == bundleID:
+	case strings.HasSuffix(pattern, "*") && strings.HasPrefix(bundleID, strings.TrimSuffix(pattern, "*")):
+		entitlements["application-identifier"] = prefix + bundleID
+	default:
+		return nil, fmt.Errorf("profile %q is for %s, not %s", profile.Name, pattern, bundleID)
+	}
+
+	return entitlements, nil
+}
+
+// names returns the paths of all files in the signed IPA.
+func (s *signer) names() []string {
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	for name := range s.modified {
+		if _, ok := s.files[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *signer) glob(pattern string) ([]string, error) {
+	matches := make([]string, 0)
+	for _, name := range s.names() {
+		ok, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, name)
+		}
+	}
+	return matches, nil
+}
+
+// read returns the contents of the named file. For symlinks, it returns
+// the target and true.
+func (s *signer) read(name string) ([]byte, bool, error) {
+	if data, ok := s.modified[name]; ok {
+		return data, false, nil
+	}
+
+	f, ok := s.files[name]
+	if !ok {
+		return nil, false, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, false, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return data, f.Mode()&fs.ModeSymlink != 0, nil
+}
+
+// write copies the IPA to w, replacing the modified files and adding the
+// new ones at the end.
+func (s *signer) write(w io.Writer, zr *zip.Reader) error {
+	zw := zip.NewWriter(w)
+
+	for _, f := range zr.File {
+		data, ok := s.modified[f.Name]
+		if !ok {
+			if err := zw.Copy(f); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fh := &zip.FileHeader{
+			Name:           f.Name,
+			Method:         zip.Deflate,
+			Modified:       f.Modified,
+			CreatorVersion: f.CreatorVersion,
+			ExternalAttrs:  f.ExternalAttrs,
+		}
+		fw, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(data); err != nil {
+			return err
+		}
+	}
+
+	added := make([]string, 0)
+	for name := range s.modified {
+		if _, ok := s.files[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+
+	for _, name := range added {
+		fh := &zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: s.signingTime,
+		}
+		fh.SetMode(0644)
+
+		fw, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(s.modified[name]); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
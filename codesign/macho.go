@@ -0,0 +1,285 @@
+package codesign
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/macho"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/romantomjak/xcdevice/internal/codesig"
+)
+
+const fatMagic = 0xcafebabe
+
+// cmsReserve is added to the estimated size of the CMS blob, as the length
+// of ECDSA signatures varies.
+const cmsReserve = 64
+
+// signingInfo is everything that goes into the signature of an executable
+// apart from the code itself.
+type signingInfo struct {
+	identifier string
+	teamID     string
+
+	// info and codeResources are the Info.plist and CodeResources of the
+	// bundle the executable belongs to. Both are nil for loose libraries.
+	info          []byte
+	codeResources []byte
+
+	// entitlements are nil for code that does not have any, e.g.
+	// frameworks.
+	entitlements map[string]interface{}
+
+	requirements []byte
+}
+
+// signMachO replaces the code signature of a thin or fat Mach-O file. It
+// returns the signed file and the cdhash of its first slice.
+func signMachO(data []byte, s *signingInfo, identity *Identity, signingTime time.Time) ([]byte, []byte, error) {
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != fatMagic {
+		return signSlice(data, s, identity, signingTime)
+	}
+
+	ff, err := macho.NewFatFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ff.Close()
+
+	slices := make([][]byte, len(ff.Arches))
+	var cdhash []byte
+	for i, arch := range ff.Arches {
+		if uint64(arch.Offset)+uint64(arch.Size) > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("slice %d out of range", i)
+		}
+
+		slice, h, err := signSlice(data[arch.Offset:arch.Offset+arch.Size], s, identity, signingTime)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", arch.Cpu, err)
+		}
+		if cdhash == nil {
+			cdhash = h
+		}
+		slices[i] = slice
+	}
+
+	header := make([]byte, 8+20*len(ff.Arches))
+	binary.BigEndian.PutUint32(header, fatMagic)
+	binary.BigEndian.PutUint32(header[4:], uint32(len(ff.Arches)))
+
+	// keep the first slice where it was and align the following ones
+	offsets := make([]uint64, len(ff.Arches))
+	offset := uint64(ff.Arches[0].Offset)
+	for i, arch := range ff.Arches {
+		align := uint64(1) << arch.Align
+		offset = (offset + align - 1) &^ (align - 1)
+		offsets[i] = offset
+
+		h := header[8+20*i:]
+		binary.BigEndian.PutUint32(h, uint32(arch.Cpu))
+		binary.BigEndian.PutUint32(h[4:], arch.SubCpu)
+		binary.BigEndian.PutUint32(h[8:], uint32(offset))
+		binary.BigEndian.PutUint32(h[12:], uint32(len(slices[i])))
+		binary.BigEndian.PutUint32(h[16:], arch.Align)
+
+		offset += uint64(len(slices[i]))
+	}
+
+	out := &bytes.Buffer{}
+	out.Write(header)
+	for i := range slices {
+		out.Write(make([]byte, offsets[i]-uint64(out.Len())))
+		out.Write(slices[i])
+	}
+
+	return out.Bytes(), cdhash, nil
+}
+
+// signSlice replaces the code signature of a thin Mach-O file.
+//
+// The new signature takes the place of the existing one at the end of the
+// __LINKEDIT segment. Executables without a signature are not supported, as
+// that would require adding a load command.
+func signSlice(data []byte, s *signingInfo, identity *Identity, signingTime time.Time) ([]byte, []byte, error) {
+	f, err := macho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	bo := f.ByteOrder
+	is64 := f.Magic == macho.Magic64
+
+	offset := 28
+	if is64 {
+		offset = 32
+	}
+
+	var sigCmd, linkeditCmd int
+	var textBase, textLimit uint64
+	for i := uint32(0); i < f.Ncmd; i++ {
+		if offset+8 > len(data) {
+			return nil, nil, fmt.Errorf("load commands out of range")
+		}
+		cmd := macho.LoadCmd(bo.Uint32(data[offset:]))
+		size := int(bo.Uint32(data[offset+4:]))
+		if size < 8 || offset+size > len(data) {
+			return nil, nil, fmt.Errorf("invalid load command size")
+		}
+		raw := data[offset : offset+size]
+
+		switch cmd {
+		case codesig.LoadCmdCodeSignature:
+			sigCmd = offset
+
+		case codesig.LoadCmdEncryptionInfo, codesig.LoadCmdEncryptionInfo64:
+			if len(raw) >= 20 && bo.Uint32(raw[16:]) != 0 {
+				return nil, nil, ErrEncrypted
+			}
+
+		case macho.LoadCmdSegment64:
+			switch string(bytes.TrimRight(raw[8:24], "\x00")) {
+			case "__TEXT":
+				textBase, textLimit = bo.Uint64(raw[40:]), bo.Uint64(raw[48:])
+			case "__LINKEDIT":
+				linkeditCmd = offset
+			}
+
+		case macho.LoadCmdSegment:
+			switch string(bytes.TrimRight(raw[8:24], "\x00")) {
+			case "__TEXT":
+				textBase, textLimit = uint64(bo.Uint32(raw[32:])), uint64(bo.Uint32(raw[36:]))
+			case "__LINKEDIT":
+				linkeditCmd = offset
+			}
+		}
+
+		offset += size
+	}
+
+	if sigCmd == 0 {
+		return nil, nil, ErrNotSigned
+	}
+	if linkeditCmd == 0 {
+		return nil, nil, fmt.Errorf("missing __LINKEDIT segment")
+	}
+
+	codeLimit := bo.Uint32(data[sigCmd+8:])
+	if int(codeLimit) > len(data) {
+		return nil, nil, fmt.Errorf("code signature out of range")
+	}
+
+	cd := &codeDirectory{
+		identifier:   s.identifier,
+		teamID:       s.teamID,
+		codeLimit:    codeLimit,
+		execSegBase:  textBase,
+		execSegLimit: textLimit,
+	}
+	if f.Type == macho.TypeExec {
+		cd.execSegFlags |= csExecSegMainBinary
+	}
+	if allow, _ := s.entitlements["get-task-allow"].(bool); allow {
+		cd.execSegFlags |= csExecSegAllowUnsigned
+	}
+
+	nSpecialSlots := codesig.SlotRequirements
+	if s.codeResources != nil {
+		nSpecialSlots = codesig.SlotResourceDir
+	}
+
+	blobs := map[uint32][]byte{
+		codesig.SlotRequirements: s.requirements,
+	}
+	if s.entitlements != nil {
+		xml, err := entitlementsBlob(s.entitlements)
+		if err != nil {
+			return nil, nil, fmt.Errorf("entitlements: %v", err)
+		}
+		der, err := entitlementsDERBlob(s.entitlements)
+		if err != nil {
+			return nil, nil, fmt.Errorf("entitlements: %v", err)
+		}
+		blobs[codesig.SlotEntitlements] = xml
+		blobs[codesig.SlotEntitlementsDER] = der
+		nSpecialSlots = codesig.SlotEntitlementsDER
+	}
+
+	cd.specialSlots = make([][]byte, nSpecialSlots+1)
+	for slot := range cd.specialSlots {
+		cd.specialSlots[slot] = make([]byte, sha256.Size)
+	}
+	setSlot := func(slot int, data []byte) {
+		h := sha256.Sum256(data)
+		cd.specialSlots[slot] = h[:]
+	}
+	if s.info != nil {
+		setSlot(codesig.SlotInfo, s.info)
+	}
+	if s.codeResources != nil {
+		setSlot(codesig.SlotResourceDir, s.codeResources)
+	}
+	for slot, b := range blobs {
+		setSlot(int(slot), b)
+	}
+
+	// the size of the signature has to be known before the code is hashed,
+	// because it is recorded in the load commands. The CMS blob has the
+	// same size for any code directory of the same length.
+	estimate, err := signatureBlob(identity, make([]byte, cd.size()), signingTime)
+	if err != nil {
+		return nil, nil, err
+	}
+	sigSize := 12 + 8*(len(blobs)+2) + cd.size() + len(estimate) + cmsReserve
+	for _, b := range blobs {
+		sigSize += len(b)
+	}
+	sigSize = (sigSize + 15) &^ 15
+
+	code := make([]byte, codeLimit)
+	copy(code, data)
+
+	bo.PutUint32(code[sigCmd+12:], uint32(sigSize))
+
+	pageSize := uint64(0x1000)
+	if f.Cpu == macho.CpuArm64 {
+		pageSize = 0x4000
+	}
+	if is64 {
+		fileoff := bo.Uint64(code[linkeditCmd+40:])
+		filesize := uint64(codeLimit) + uint64(sigSize) - fileoff
+		bo.PutUint64(code[linkeditCmd+48:], filesize)
+		bo.PutUint64(code[linkeditCmd+32:], (filesize+pageSize-1)&^(pageSize-1))
+	} else {
+		fileoff := uint64(bo.Uint32(code[linkeditCmd+32:]))
+		filesize := uint64(codeLimit) + uint64(sigSize) - fileoff
+		bo.PutUint32(code[linkeditCmd+36:], uint32(filesize))
+		bo.PutUint32(code[linkeditCmd+28:], uint32((filesize+pageSize-1)&^(pageSize-1)))
+	}
+
+	codeDirectory := cd.encode(code)
+	blobs[codesig.SlotCodeDirectory] = codeDirectory
+
+	cms, err := signatureBlob(identity, codeDirectory, signingTime)
+	if err != nil {
+		return nil, nil, err
+	}
+	blobs[codesig.SlotSignature] = cms
+
+	signature := superBlob(blobs)
+	if len(signature) > sigSize {
+		return nil, nil, errors.New("code signature exceeds the reserved space")
+	}
+
+	out := make([]byte, 0, len(code)+sigSize)
+	out = append(out, code...)
+	out = append(out, signature...)
+	out = append(out, make([]byte, sigSize-len(signature))...)
+
+	cdhash := sha256.Sum256(codeDirectory)
+
+	return out, cdhash[:20], nil
+}
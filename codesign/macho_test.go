@@ -0,0 +1,525 @@
+package codesign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"debug/macho"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/romantomjak/xcdevice/internal/codesig"
+	"github.com/romantomjak/xcdevice/machoinfo"
+)
+
+const (
+	fixtureTextSize     = 0x4000
+	fixtureLinkeditSize = 0x100
+	fixtureOldSigSize   = 0x200
+)
+
+// machoFixture returns a minimal 64-bit executable with __TEXT and
+// __LINKEDIT segments and a zeroed code signature at the end of __LINKEDIT,
+// like the ones the linker produces.
+func machoFixture(t *testing.T, cpu macho.Cpu, subCpu uint32, cryptID uint32, signed bool) []byte {
+	t.Helper()
+
+	le := binary.LittleEndian
+	cmds := &bytes.Buffer{}
+	ncmds := uint32(0)
+
+	segment := func(name string, vmaddr, vmsize, fileoff, filesize uint64) {
+		b := make([]byte, 72)
+		le.PutUint32(b, uint32(macho.LoadCmdSegment64))
+		le.PutUint32(b[4:], 72)
+		copy(b[8:24], name)
+		le.PutUint64(b[24:], vmaddr)
+		le.PutUint64(b[32:], vmsize)
+		le.PutUint64(b[40:], fileoff)
+		le.PutUint64(b[48:], filesize)
+		le.PutUint32(b[56:], 5) // maxprot
+		le.PutUint32(b[60:], 5) // initprot
+		cmds.Write(b)
+		ncmds++
+	}
+
+	linkeditSize := uint64(fixtureLinkeditSize)
+	if signed {
+		linkeditSize += fixtureOldSigSize
+	}
+
+	segment("__TEXT", 0x100000000, fixtureTextSize, 0, fixtureTextSize)
+	segment("__LINKEDIT", 0x100000000+fixtureTextSize, 0x4000, fixtureTextSize, linkeditSize)
+
+	if cryptID != 0 {
+		b := make([]byte, 24)
+		le.PutUint32(b, uint32(codesig.LoadCmdEncryptionInfo64))
+		le.PutUint32(b[4:], 24)
+		le.PutUint32(b[8:], 0x1000)
+		le.PutUint32(b[12:], 0x1000)
+		le.PutUint32(b[16:], cryptID)
+		cmds.Write(b)
+		ncmds++
+	}
+
+	if signed {
+		b := make([]byte, 16)
+		le.PutUint32(b, uint32(codesig.LoadCmdCodeSignature))
+		le.PutUint32(b[4:], 16)
+		le.PutUint32(b[8:], fixtureTextSize+fixtureLinkeditSize)
+		le.PutUint32(b[12:], fixtureOldSigSize)
+		cmds.Write(b)
+		ncmds++
+	}
+
+	data := make([]byte, fixtureTextSize+linkeditSize)
+	le.PutUint32(data, macho.Magic64)
+	le.PutUint32(data[4:], uint32(cpu))
+	le.PutUint32(data[8:], subCpu)
+	le.PutUint32(data[12:], uint32(macho.TypeExec))
+	le.PutUint32(data[16:], ncmds)
+	le.PutUint32(data[20:], uint32(cmds.Len()))
+	copy(data[32:], cmds.Bytes())
+
+	// fill the code after the load commands, so that every page hash is
+	// different
+	for i := 32 + cmds.Len(); i < fixtureTextSize+fixtureLinkeditSize; i++ {
+		data[i] = byte(i * 7 / 3)
+	}
+
+	return data
+}
+
+// fatFixture combines thin files into a fat file with 16 KiB aligned slices.
+func fatFixture(slices ...[]byte) []byte {
+	const align = 14
+
+	header := make([]byte, 8+20*len(slices))
+	binary.BigEndian.PutUint32(header, fatMagic)
+	binary.BigEndian.PutUint32(header[4:], uint32(len(slices)))
+
+	out := &bytes.Buffer{}
+	out.Write(header)
+	for i, s := range slices {
+		offset := (out.Len() + 1<<align - 1) &^ (1<<align - 1)
+		out.Write(make([]byte, offset-out.Len()))
+
+		h := out.Bytes()[8+20*i:]
+		binary.BigEndian.PutUint32(h, binary.LittleEndian.Uint32(s[4:]))
+		binary.BigEndian.PutUint32(h[4:], binary.LittleEndian.Uint32(s[8:]))
+		binary.BigEndian.PutUint32(h[8:], uint32(offset))
+		binary.BigEndian.PutUint32(h[12:], uint32(len(s)))
+		binary.BigEndian.PutUint32(h[16:], align)
+
+		out.Write(s)
+	}
+
+	return out.Bytes()
+}
+
+// testIdentity returns a leaf certificate issued by a throwaway root, named
+// like Apple's development certificates.
+func testIdentity(t *testing.T, rsaKey bool) *Identity {
+	t.Helper()
+
+	newKey := func() crypto.Signer {
+		if rsaKey {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return key
+		}
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	rootKey := newKey()
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, root, root, rootKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCert, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafKey := newKey()
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject: pkix.Name{
+			CommonName:         "Apple Development: Test (ABCDE12345)",
+			OrganizationalUnit: []string{"ABCDE12345"},
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+		KeyUsage:  x509.KeyUsageDigitalSignature,
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, rootCert, leafKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafCert, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Identity{Certificate: leafCert, Chain: []*x509.Certificate{rootCert}, PrivateKey: leafKey}
+}
+
+func testSigningInfo(t *testing.T, identity *Identity) *signingInfo {
+	t.Helper()
+
+	_, requirements := designatedRequirement("com.example.app", identity.Certificate.Subject.CommonName)
+
+	return &signingInfo{
+		identifier:    "com.example.app",
+		teamID:        identity.TeamID(),
+		info:          []byte("<plist>info</plist>"),
+		codeResources: []byte("<plist>resources</plist>"),
+		entitlements: map[string]interface{}{
+			"application-identifier": "ABCDE12345.com.example.app",
+			"get-task-allow":         true,
+			"keychain-access-groups": []interface{}{"ABCDE12345.com.example.app"},
+		},
+		requirements: requirements,
+	}
+}
+
+// checkSignedSlice checks the load commands, code directory and CMS
+// signature of a signed thin file.
+func checkSignedSlice(t *testing.T, slice []byte, codeLimit int, si *signingInfo, identity *Identity) []byte {
+	t.Helper()
+
+	f, err := macho.NewFile(bytes.NewReader(slice))
+	if err != nil {
+		t.Fatalf("parse signed file: %v", err)
+	}
+	defer f.Close()
+
+	var dataoff, datasize uint32
+	var linkedit *macho.Segment
+	for _, l := range f.Loads {
+		raw := l.Raw()
+		if macho.LoadCmd(f.ByteOrder.Uint32(raw)) == codesig.LoadCmdCodeSignature {
+			dataoff = f.ByteOrder.Uint32(raw[8:])
+			datasize = f.ByteOrder.Uint32(raw[12:])
+		}
+		if s, ok := l.(*macho.Segment); ok && s.Name == "__LINKEDIT" {
+			linkedit = s
+		}
+	}
+
+	if int(dataoff) != codeLimit {
+		t.Errorf("signature offset = %#x, want %#x", dataoff, codeLimit)
+	}
+	if int(dataoff)+int(datasize) != len(slice) {
+		t.Errorf("signature ends at %#x, file size is %#x", dataoff+datasize, len(slice))
+	}
+	if linkedit == nil {
+		t.Fatal("missing __LINKEDIT")
+	}
+	if linkedit.Offset+linkedit.Filesz != uint64(len(slice)) {
+		t.Errorf("__LINKEDIT ends at %#x, file size is %#x", linkedit.Offset+linkedit.Filesz, len(slice))
+	}
+	if linkedit.Memsz < linkedit.Filesz || linkedit.Memsz%0x4000 != 0 {
+		t.Errorf("__LINKEDIT vmsize = %#x, filesize = %#x", linkedit.Memsz, linkedit.Filesz)
+	}
+
+	signature := slice[dataoff : dataoff+datasize]
+	if got := binary.BigEndian.Uint32(signature); got != codesig.MagicEmbeddedSignature {
+		t.Fatalf("signature magic = %#x", got)
+	}
+
+	blobs := make(map[uint32][]byte)
+	count := binary.BigEndian.Uint32(signature[8:])
+	for i := uint32(0); i < count; i++ {
+		slot := binary.BigEndian.Uint32(signature[12+8*i:])
+		offset := binary.BigEndian.Uint32(signature[16+8*i:])
+		length := binary.BigEndian.Uint32(signature[offset+4:])
+		blobs[slot] = signature[offset : offset+length]
+	}
+
+	cd := blobs[codesig.SlotCodeDirectory]
+	if cd == nil {
+		t.Fatal("missing code directory")
+	}
+
+	be := binary.BigEndian
+	hashOffset := int(be.Uint32(cd[16:]))
+	nSpecialSlots := int(be.Uint32(cd[24:]))
+	nCodeSlots := int(be.Uint32(cd[28:]))
+	if limit := int(be.Uint32(cd[32:])); limit != codeLimit {
+		t.Errorf("code limit = %#x, want %#x", limit, codeLimit)
+	}
+	if cd[36] != sha256.Size || cd[37] != csHashTypeSHA256 || cd[39] != csPageShift {
+		t.Errorf("hash size, type and page shift = %d, %d, %d", cd[36], cd[37], cd[39])
+	}
+
+	// the code slots cover everything up to the signature, including the
+	// updated load commands
+	if want := (codeLimit + csPageSize - 1) / csPageSize; nCodeSlots != want {
+		t.Fatalf("code slots = %d, want %d", nCodeSlots, want)
+	}
+	for i := 0; i < nCodeSlots; i++ {
+		end := (i + 1) * csPageSize
+		if end > codeLimit {
+			end = codeLimit
+		}
+		want := sha256.Sum256(slice[i*csPageSize : end])
+		got := cd[hashOffset+i*sha256.Size : hashOffset+(i+1)*sha256.Size]
+		if !bytes.Equal(got, want[:]) {
+			t.Errorf("page %d hash mismatch", i)
+		}
+	}
+
+	specialSlot := func(slot int) []byte {
+		return cd[hashOffset-slot*sha256.Size : hashOffset-(slot-1)*sha256.Size]
+	}
+	sum := func(b []byte) []byte {
+		h := sha256.Sum256(b)
+		return h[:]
+	}
+
+	if nSpecialSlots != codesig.SlotEntitlementsDER {
+		t.Errorf("special slots = %d, want %d", nSpecialSlots, codesig.SlotEntitlementsDER)
+	}
+	for slot, want := range map[int][]byte{
+		codesig.SlotInfo:            sum(si.info),
+		codesig.SlotRequirements:    sum(blobs[codesig.SlotRequirements]),
+		codesig.SlotResourceDir:     sum(si.codeResources),
+		4:                           make([]byte, sha256.Size),
+		codesig.SlotEntitlements:    sum(blobs[codesig.SlotEntitlements]),
+		6:                           make([]byte, sha256.Size),
+		codesig.SlotEntitlementsDER: sum(blobs[codesig.SlotEntitlementsDER]),
+	} {
+		if !bytes.Equal(specialSlot(slot), want) {
+			t.Errorf("special slot %d = %x, want %x", slot, specialSlot(slot), want)
+		}
+	}
+	if !bytes.Equal(blobs[codesig.SlotRequirements], si.requirements) {
+		t.Error("requirements blob differs")
+	}
+
+	checkCMS(t, blobs[codesig.SlotSignature], cd, identity)
+
+	cdhash := sha256.Sum256(cd)
+	return cdhash[:20]
+}
+
+// checkCMS verifies the CMS signature of the code directory.
+func checkCMS(t *testing.T, b []byte, cd []byte, identity *Identity) {
+	t.Helper()
+
+	if b == nil || binary.BigEndian.Uint32(b) != codesig.MagicBlobWrapper {
+		t.Fatal("missing CMS blob")
+	}
+
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(b[8:], &ci); err != nil {
+		t.Fatalf("content info: %v", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		t.Fatalf("content type = %v", ci.ContentType)
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatalf("signed data: %v", err)
+	}
+	if len(sd.SignerInfos) != 1 {
+		t.Fatalf("signer infos = %d", len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+
+	var attrs []attribute
+	rest := si.SignedAttrs.Bytes
+	for len(rest) > 0 {
+		var a attribute
+		var err error
+		rest, err = asn1.Unmarshal(rest, &a)
+		if err != nil {
+			t.Fatalf("signed attribute: %v", err)
+		}
+		attrs = append(attrs, a)
+	}
+
+	digest := sha256.Sum256(cd)
+	found := false
+	for _, a := range attrs {
+		if a.Type.Equal(oidMessageDigest) {
+			var md []byte
+			if _, err := asn1.Unmarshal(a.Values[0].FullBytes, &md); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(md, digest[:]) {
+				t.Error("message digest does not match the code directory")
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Error("missing message digest attribute")
+	}
+
+	// the signature covers the attributes with their SET tag
+	signed, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: si.SignedAttrs.Bytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	algorithm := x509.SHA256WithRSA
+	if _, ok := identity.PrivateKey.Public().(*ecdsa.PublicKey); ok {
+		algorithm = x509.ECDSAWithSHA256
+	}
+	if err := identity.Certificate.CheckSignature(algorithm, signed, si.Signature); err != nil {
+		t.Errorf("CMS signature: %v", err)
+	}
+}
+
+func TestSignMachO(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rsa  bool
+	}{
+		{"ecdsa", false},
+		{"rsa", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			identity := testIdentity(t, tc.rsa)
+			si := testSigningInfo(t, identity)
+
+			data := machoFixture(t, macho.CpuArm64, 0, 0, true)
+			codeLimit := fixtureTextSize + fixtureLinkeditSize
+
+			signed, cdhash, err := signMachO(data, si, identity, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(signed[fixtureTextSize:codeLimit], data[fixtureTextSize:codeLimit]) {
+				t.Error("code after the load commands changed")
+			}
+
+			if want := checkSignedSlice(t, signed, codeLimit, si, identity); !bytes.Equal(cdhash, want) {
+				t.Errorf("cdhash = %x, want %x", cdhash, want)
+			}
+
+			slices, err := machoinfo.Parse(bytes.NewReader(signed), int64(len(signed)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(slices) != 1 {
+				t.Fatalf("slices = %d", len(slices))
+			}
+			s := slices[0]
+			if !s.Signed || s.Identifier != si.identifier || s.TeamID != si.teamID {
+				t.Errorf("machoinfo = %+v", s)
+			}
+			if !reflect.DeepEqual(s.Entitlements, si.entitlements) {
+				t.Errorf("entitlements = %v, want %v", s.Entitlements, si.entitlements)
+			}
+
+			// signing again replaces the signature rather than appending
+			// another one
+			again, _, err := signMachO(signed, si, identity, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkSignedSlice(t, again, codeLimit, si, identity)
+		})
+	}
+}
+
+func TestSignMachOFat(t *testing.T) {
+	identity := testIdentity(t, false)
+	si := testSigningInfo(t, identity)
+
+	arm64 := machoFixture(t, macho.CpuArm64, 0, 0, true)
+	arm64e := machoFixture(t, macho.CpuArm64, 2, 0, true)
+
+	signed, cdhash, err := signMachO(fatFixture(arm64, arm64e), si, identity, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ff, err := macho.NewFatFile(bytes.NewReader(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+
+	if len(ff.Arches) != 2 {
+		t.Fatalf("arches = %d", len(ff.Arches))
+	}
+	for i, arch := range ff.Arches {
+		if arch.Offset%(1<<arch.Align) != 0 {
+			t.Errorf("slice %d at %#x is not aligned", i, arch.Offset)
+		}
+		if uint64(arch.Offset)+uint64(arch.Size) > uint64(len(signed)) {
+			t.Fatalf("slice %d out of range", i)
+		}
+		h := checkSignedSlice(t, signed[arch.Offset:arch.Offset+arch.Size], fixtureTextSize+fixtureLinkeditSize, si, identity)
+		if i == 0 && !bytes.Equal(h, cdhash) {
+			t.Errorf("cdhash = %x, want the one of the first slice %x", cdhash, h)
+		}
+	}
+
+	slices, err := machoinfo.Parse(bytes.NewReader(signed), int64(len(signed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archs []string
+	for _, s := range slices {
+		if !s.Signed {
+			t.Errorf("%s is not signed", s.Architecture)
+		}
+		archs = append(archs, s.Architecture)
+	}
+	if !reflect.DeepEqual(archs, []string{"arm64", "arm64e"}) {
+		t.Errorf("architectures = %v", archs)
+	}
+}
+
+func TestSignMachOErrors(t *testing.T) {
+	identity := testIdentity(t, false)
+	si := testSigningInfo(t, identity)
+
+	_, _, err := signMachO(machoFixture(t, macho.CpuArm64, 0, 0, false), si, identity, time.Now())
+	if !errors.Is(err, ErrNotSigned) {
+		t.Errorf("unsigned: err = %v, want ErrNotSigned", err)
+	}
+
+	_, _, err = signMachO(machoFixture(t, macho.CpuArm64, 0, 1, true), si, identity, time.Now())
+	if !errors.Is(err, ErrEncrypted) {
+		t.Errorf("encrypted: err = %v, want ErrEncrypted", err)
+	}
+
+	data := machoFixture(t, macho.CpuArm64, 0, 0, true)
+	_, _, err = signMachO(data[:fixtureTextSize], si, identity, time.Now())
+	if err == nil {
+		t.Error("truncated: expected an error")
+	}
+}
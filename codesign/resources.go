@@ -0,0 +1,159 @@
+package codesign
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"regexp"
+	"strings"
+
+	"howett.net/plist"
+)
+
+var (
+	// resourceOmitted matches the files rules2 excludes from the seal.
+	resourceOmitted = regexp.MustCompile(`^(.*/)?\.DS_Store$|^Info\.plist$|^PkgInfo$|^.*\.lproj/locversion\.plist$`)
+
+	// resourceOptional matches localizations, which may be removed without
+	// breaking the seal. Base.lproj is required.
+	resourceOptional = regexp.MustCompile(`^.*\.lproj/`)
+)
+
+// resourceRules are the rules codesign uses for iOS bundles. rules applies
+// to the legacy files dictionary, rules2 to files2.
+var resourceRules = map[string]interface{}{
+	"^.*": true,
+	`^.*\.lproj/`: map[string]interface{}{
+		"optional": true,
+		"weight":   1000.0,
+	},
+	`^.*\.lproj/locversion.plist$`: map[string]interface{}{
+		"omit":   true,
+		"weight": 1100.0,
+	},
+	`^Base\.lproj/`: map[string]interface{}{
+		"weight": 1010.0,
+	},
+	"^version.plist$": true,
+}
+
+var resourceRules2 = map[string]interface{}{
+	`.*\.dSYM($|/)`: map[string]interface{}{
+		"weight": 11.0,
+	},
+	`^(.*/)?\.DS_Store$`: map[string]interface{}{
+		"omit":   true,
+		"weight": 2000.0,
+	},
+	"^.*": true,
+	`^.*\.lproj/`: map[string]interface{}{
+		"optional": true,
+		"weight":   1000.0,
+	},
+	`^.*\.lproj/locversion.plist$`: map[string]interface{}{
+		"omit":   true,
+		"weight": 1100.0,
+	},
+	`^Base\.lproj/`: map[string]interface{}{
+		"weight": 1010.0,
+	},
+	`^Info\.plist$`: map[string]interface{}{
+		"omit":   true,
+		"weight": 20.0,
+	},
+	`^PkgInfo$`: map[string]interface{}{
+		"omit":   true,
+		"weight": 20.0,
+	},
+	`^embedded\.provisionprofile$`: map[string]interface{}{
+		"weight": 20.0,
+	},
+	`^version\.plist$`: map[string]interface{}{
+		"weight": 20.0,
+	},
+}
+
+// resource is a file of a bundle, relative to the bundle.
+type resource struct {
+	name string
+	data []byte
+
+	// symlink is the target of symbolic links, data is unused for them.
+	symlink string
+}
+
+// nestedCode is the seal of a bundle nested in another one.
+type nestedCode struct {
+	cdhash      []byte
+	requirement string
+}
+
+// codeResources returns the _CodeSignature/CodeResources of a bundle. The
+// resources must not include the bundle executable or its _CodeSignature,
+// nested maps the path of nested bundles to their seals.
+//
+// The legacy files dictionary seals every file with SHA-1, including the
+// contents of nested bundles. files2 seals them with SHA-256, nested bundles
+// by their cdhash, and records symlinks.
+func codeResources(resources []resource, nested map[string]nestedCode) ([]byte, error) {
+	files := make(map[string]interface{})
+	files2 := make(map[string]interface{})
+
+	for _, r := range resources {
+		optional := resourceOptional.MatchString(r.name) && !strings.HasPrefix(r.name, "Base.lproj/")
+
+		if r.symlink != "" {
+			if !isNestedResource(r.name, nested) && !resourceOmitted.MatchString(r.name) {
+				files2[r.name] = map[string]interface{}{"symlink": r.symlink}
+			}
+			continue
+		}
+
+		sum1 := sha1.Sum(r.data)
+		sum2 := sha256.Sum256(r.data)
+
+		if !strings.HasSuffix(r.name, "/locversion.plist") {
+			if optional {
+				files[r.name] = map[string]interface{}{"hash": sum1[:], "optional": true}
+			} else {
+				files[r.name] = sum1[:]
+			}
+		}
+
+		if isNestedResource(r.name, nested) || resourceOmitted.MatchString(r.name) {
+			continue
+		}
+
+		seal := map[string]interface{}{
+			"hash":  sum1[:],
+			"hash2": sum2[:],
+		}
+		if optional {
+			seal["optional"] = true
+		}
+		files2[r.name] = seal
+	}
+
+	for name, n := range nested {
+		files2[name] = map[string]interface{}{
+			"cdhash":      n.cdhash,
+			"requirement": n.requirement,
+		}
+	}
+
+	return plist.MarshalIndent(map[string]interface{}{
+		"files":  files,
+		"files2": files2,
+		"rules":  resourceRules,
+		"rules2": resourceRules2,
+	}, plist.XMLFormat, "\t")
+}
+
+// isNestedResource reports whether name is inside one of the nested bundles.
+func isNestedResource(name string, nested map[string]nestedCode) bool {
+	for n := range nested {
+		if strings.HasPrefix(name, n+"/") {
+			return true
+		}
+	}
+	return false
+}
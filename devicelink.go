@@ -0,0 +1,80 @@
+package xcdevice
+
+import (
+	"fmt"
+	"net"
+)
+
+// deviceLink implements the DeviceLink protocol used by services like
+// screenshotr and mobilebackup2. Messages are length prefixed plist arrays
+// whose first element is the message type.
+type deviceLink struct {
+	conn net.Conn
+}
+
+// versionExchange performs the handshake every DeviceLink connection starts
+// with. The device announces its protocol version, which is accepted as is,
+// and then signals that it is ready.
+func (d *deviceLink) versionExchange() error {
+	msg, err := d.receive()
+	if err != nil {
+		return err
+	}
+	if len(msg) < 2 || msg[0] != "DLMessageVersionExchange" {
+		return fmt.Errorf("unexpected message %v", msg)
+	}
+
+	if err := sendPlist(d.conn, []interface{}{"DLMessageVersionExchange", "DLVersionsOk", msg[1]}); err != nil {
+		return err
+	}
+
+	msg, err = d.receive()
+	if err != nil {
+		return err
+	}
+	if len(msg) < 1 || msg[0] != "DLMessageDeviceReady" {
+		return fmt.Errorf("unexpected message %v", msg)
+	}
+
+	return nil
+}
+
+// processMessage sends a message to the service and returns its reply.
+func (d *deviceLink) processMessage(message map[string]interface{}) (map[string]interface{}, error) {
+	if err := sendPlist(d.conn, []interface{}{"DLMessageProcessMessage", message}); err != nil {
+		return nil, err
+	}
+
+	msg, err := d.receive()
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) < 2 || msg[0] != "DLMessageProcessMessage" {
+		return nil, fmt.Errorf("unexpected message %v", msg)
+	}
+
+	reply, ok := msg[1].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply of type %T", msg[1])
+	}
+
+	return reply, nil
+}
+
+// disconnect tells the service the client is done and closes the
+// connection.
+func (d *deviceLink) disconnect() error {
+	err := sendPlist(d.conn, []interface{}{"DLMessageDisconnect", "___EmptyParameterString___"})
+	if cerr := d.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (d *deviceLink) receive() ([]interface{}, error) {
+	msg := make([]interface{}, 0)
+	if err := receivePlist(d.conn, &msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,256 @@
+package xcdevice
+
+import (
+	"fmt"
+	"net"
+)
+
+// DiagnosticsType selects the diagnostics returned by Diagnostics.
+type DiagnosticsType string
+
+const (
+	DiagnosticsTypeAll      DiagnosticsType = "All"
+	DiagnosticsTypeWiFi     DiagnosticsType = "WiFi"
+	DiagnosticsTypeGasGauge DiagnosticsType = "GasGauge"
+	DiagnosticsTypeNAND     DiagnosticsType = "NAND"
+)
+
+// IORegistryQuery selects the IORegistry entries returned by IORegistry.
+// Empty fields are not sent, an empty query returns the root of the
+// registry.
+type IORegistryQuery struct {
+	// Plane is the registry plane, e.g. "IODeviceTree" or "IOPower".
+	Plane string
+
+	// Name is the name of an entry, e.g. "AppleARMPMUCharger".
+	Name string
+
+	// Class is the class of an entry, e.g. "IOPMPowerSource".
+	Class string
+}
+
+type diagnosticsActionRequest struct {
+	Request           string
+	WaitForDisconnect bool
+	DisplayPass       bool
+	DisplayFail       bool
+}
+
+type diagnosticsRequest struct {
+	Request string
+}
+
+type ioRegistryRequest struct {
+	Request      string
+	CurrentPlane string `plist:",omitempty"`
+	EntryName    string `plist:",omitempty"`
+	EntryClass   string `plist:",omitempty"`
+}
+
+type mobileGestaltRequest struct {
+	Request           string
+	MobileGestaltKeys []string
+}
+
+type diagnosticsResponse struct {
+	Status      string
+	Diagnostics map[string]interface{}
+}
+
+// DiagnosticsRelay is a client of com.apple.mobile.diagnostics_relay, which
+// restarts, shuts down or sleeps the device and queries its IORegistry,
+// MobileGestalt and diagnostics.
+type DiagnosticsRelay struct {
+	conn net.Conn
+}
+
+// RestartDevice restarts the device once the connection to the service is
+// closed.
+func RestartDevice(device *Device) error {
+	return diagnosticsAction(device, (*DiagnosticsRelay).Restart)
+}
+
+// ShutdownDevice shuts the device down once the connection to the service
+// is closed.
+func ShutdownDevice(device *Device) error {
+	return diagnosticsAction(device, (*DiagnosticsRelay).Shutdown)
+}
+
+// SleepDevice puts the device to sleep.
+func SleepDevice(device *Device) error {
+	return diagnosticsAction(device, (*DiagnosticsRelay).Sleep)
+}
+
+// IORegistry returns the IORegistry entries matching the query.
+func IORegistry(device *Device, query IORegistryQuery) (map[string]interface{}, error) {
+	relay, err := diagnosticsRelayService(device)
+	if err != nil {
+		return nil, err
+	}
+	defer relay.Close()
+
+	return relay.IORegistry(query)
+}
+
+// MobileGestalt returns the values of the MobileGestalt keys, e.g.
+// "ProductType" or "BatteryCurrentCapacity".
+func MobileGestalt(device *Device, keys ...string) (map[string]interface{}, error) {
+	relay, err := diagnosticsRelayService(device)
+	if err != nil {
+		return nil, err
+	}
+	defer relay.Close()
+
+	return relay.MobileGestalt(keys...)
+}
+
+// Diagnostics returns the diagnostics of the given type.
+func Diagnostics(device *Device, diagnosticsType DiagnosticsType) (map[string]interface{}, error) {
+	relay, err := diagnosticsRelayService(device)
+	if err != nil {
+		return nil, err
+	}
+	defer relay.Close()
+
+	return relay.Diagnostics(diagnosticsType)
+}
+
+func diagnosticsAction(device *Device, action func(*DiagnosticsRelay) error) error {
+	relay, err := diagnosticsRelayService(device)
+	if err != nil {
+		return err
+	}
+
+	if err := action(relay); err != nil {
+		relay.conn.Close()
+		return err
+	}
+
+	return relay.Close()
+}
+
+func diagnosticsRelayService(device *Device) (*DiagnosticsRelay, error) {
+	lockdown, err := LockdownService(device)
+	if err != nil {
+		return nil, fmt.Errorf("lockdown: %v", err)
+	}
+
+	relay, err := lockdown.DiagnosticsRelayService()
+	if err != nil {
+		return nil, fmt.Errorf("diagnostics relay: %v", err)
+	}
+
+	return relay, nil
+}
+
+// Restart asks the device to restart once the client disconnects.
+func (d *DiagnosticsRelay) Restart() error {
+	return d.action("Restart")
+}
+
+// Shutdown asks the device to shut down once the client disconnects.
+func (d *DiagnosticsRelay) Shutdown() error {
+	return d.action("Shutdown")
+}
+
+// Sleep puts the device to sleep.
+func (d *DiagnosticsRelay) Sleep() error {
+	_, err := d.request(diagnosticsRequest{Request: "Sleep"})
+	return err
+}
+
+// Goodbye ends the session. Restart and Shutdown take effect afterwards.
+func (d *DiagnosticsRelay) Goodbye() error {
+	_, err := d.request(diagnosticsRequest{Request: "Goodbye"})
+	return err
+}
+
+// IORegistry returns the IORegistry entries matching the query.
+func (d *DiagnosticsRelay) IORegistry(query IORegistryQuery) (map[string]interface{}, error) {
+	resp, err := d.request(ioRegistryRequest{
+		Request:      "IORegistry",
+		CurrentPlane: query.Plane,
+		EntryName:    query.Name,
+		EntryClass:   query.Class,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	registry, _ := resp.Diagnostics["IORegistry"].(map[string]interface{})
+	if registry == nil {
+		return nil, fmt.Errorf("no IORegistry entries")
+	}
+
+	return registry, nil
+}
+
+// MobileGestalt returns the values of the MobileGestalt keys. Keys the
+// device does not know or no longer exposes are missing from the result.
+func (d *DiagnosticsRelay) MobileGestalt(keys ...string) (map[string]interface{}, error) {
+	resp, err := d.request(mobileGestaltRequest{
+		Request:           "MobileGestalt",
+		MobileGestaltKeys: keys,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values, _ := resp.Diagnostics["MobileGestalt"].(map[string]interface{})
+	if values == nil {
+		return nil, fmt.Errorf("no MobileGestalt values")
+	}
+
+	if status, _ := values["Status"].(string); status != "MobileGestaltSuccess" {
+		return nil, fmt.Errorf("mobile gestalt: %s", status)
+	}
+	delete(values, "Status")
+
+	return values, nil
+}
+
+// Diagnostics returns the diagnostics of the given type.
+func (d *DiagnosticsRelay) Diagnostics(diagnosticsType DiagnosticsType) (map[string]interface{}, error) {
+	resp, err := d.request(diagnosticsRequest{Request: string(diagnosticsType)})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Diagnostics, nil
+}
+
+// Close says goodbye to the service and closes the connection.
+func (d *DiagnosticsRelay) Close() error {
+	err := d.Goodbye()
+	if cerr := d.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (d *DiagnosticsRelay) action(request string) error {
+	_, err := d.request(diagnosticsActionRequest{
+		Request:           request,
+		WaitForDisconnect: true,
+		DisplayPass:       true,
+		DisplayFail:       true,
+	})
+	return err
+}
+
+func (d *DiagnosticsRelay) request(req interface{}) (*diagnosticsResponse, error) {
+	if err := sendPlist(d.conn, req); err != nil {
+		return nil, err
+	}
+
+	resp := &diagnosticsResponse{}
+	if err := receivePlist(d.conn, resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Status != "Success" {
+		return nil, fmt.Errorf("diagnostics relay: %s", resp.Status)
+	}
+
+	return resp, nil
+}
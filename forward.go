@@ -0,0 +1,203 @@
+package xcdevice
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ForwardStats are the connection counters of a Forwarder.
+type ForwardStats struct {
+	// Active is the number of connections currently being forwarded.
+	Active int64
+
+	// Total is the number of accepted connections, including the ones that
+	// could not be forwarded.
+	Total int64
+
+	// Failed is the number of connections the device refused.
+	Failed int64
+
+	// BytesSent and BytesReceived are the number of bytes forwarded to and
+	// from the device.
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// Forwarder accepts local TCP connections and tunnels each one to a port on
+// the device through usbmuxd, like iproxy does.
+type Forwarder struct {
+	device     *Device
+	devicePort int
+	listener   net.Listener
+
+	active        int64
+	total         int64
+	failed        int64
+	bytesSent     int64
+	bytesReceived int64
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Forward listens on the local address, e.g. "127.0.0.1:8100", and returns
+// a Forwarder for the device port. Connections are accepted once Serve is
+// called.
+func Forward(device *Device, localAddr string, devicePort int) (*Forwarder, error) {
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Forwarder{
+		device:     device,
+		devicePort: devicePort,
+		listener:   listener,
+		conns:      make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Addr returns the local address the forwarder listens on.
+func (f *Forwarder) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+// Serve accepts connections until the forwarder is closed, in which case it
+// returns nil.
+func (f *Forwarder) Serve() error {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			if f.isClosed() {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		atomic.AddInt64(&f.total, 1)
+
+		// the wait group is only added to while the forwarder is open, so
+		// Close never waits while connections are still being added
+		f.mu.Lock()
+		if f.closed {
+			f.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		f.conns[conn] = struct{}{}
+		f.wg.Add(1)
+		f.mu.Unlock()
+
+		go func() {
+			defer f.wg.Done()
+			defer f.untrack(conn)
+			f.forward(conn)
+		}()
+	}
+}
+
+// Close stops accepting connections, closes the ones being forwarded and
+// waits for them to finish.
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.mu.Unlock()
+
+	err := f.listener.Close()
+	f.wg.Wait()
+
+	return err
+}
+
+// Stats returns a snapshot of the connection counters.
+func (f *Forwarder) Stats() ForwardStats {
+	return ForwardStats{
+		Active:        atomic.LoadInt64(&f.active),
+		Total:         atomic.LoadInt64(&f.total),
+		Failed:        atomic.LoadInt64(&f.failed),
+		BytesSent:     atomic.LoadInt64(&f.bytesSent),
+		BytesReceived: atomic.LoadInt64(&f.bytesReceived),
+	}
+}
+
+func (f *Forwarder) forward(local net.Conn) {
+	log.Printf("forward %s => device:%d\n", local.RemoteAddr(), f.devicePort)
+
+	remote, err := DialDevice(f.device, f.devicePort)
+	if err != nil {
+		log.Printf("forward %s: %v\n", local.RemoteAddr(), err)
+		atomic.AddInt64(&f.failed, 1)
+		local.Close()
+		return
+	}
+
+	if !f.track(remote) {
+		remote.Close()
+		local.Close()
+		return
+	}
+	defer f.untrack(remote)
+
+	atomic.AddInt64(&f.active, 1)
+	defer atomic.AddInt64(&f.active, -1)
+
+	// closing both connections once either side is done unblocks the other
+	// copy
+	done := make(chan struct{}, 2)
+	go func() {
+		n, _ := io.Copy(remote, local)
+		atomic.AddInt64(&f.bytesSent, n)
+		done <- struct{}{}
+	}()
+	go func() {
+		n, _ := io.Copy(local, remote)
+		atomic.AddInt64(&f.bytesReceived, n)
+		done <- struct{}{}
+	}()
+
+	<-done
+	local.Close()
+	remote.Close()
+	<-done
+
+	log.Printf("forward %s closed\n", local.RemoteAddr())
+}
+
+// track registers conn so that Close can close it. It returns false if the
+// forwarder is already closed.
+func (f *Forwarder) track(conn net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return false
+	}
+	f.conns[conn] = struct{}{}
+
+	return true
+}
+
+func (f *Forwarder) untrack(conn net.Conn) {
+	f.mu.Lock()
+	delete(f.conns, conn)
+	f.mu.Unlock()
+}
+
+func (f *Forwarder) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
@@ -2,4 +2,8 @@ module github.com/romantomjak/xcdevice
 
 go 1.18
 
-require howett.net/plist v1.0.0
+require (
+	golang.org/x/crypto v0.24.0
+	golang.org/x/image v0.24.0
+	howett.net/plist v1.0.0
+)
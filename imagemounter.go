@@ -0,0 +1,541 @@
+package xcdevice
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"howett.net/plist"
+)
+
+// ImageType is the type of a disk image handled by the image mounter.
+type ImageType string
+
+const (
+	// ImageTypeDeveloper is the developer disk image shipped with Xcode up
+	// to iOS 16, signed by a detached signature.
+	ImageTypeDeveloper ImageType = "Developer"
+
+	// ImageTypePersonalized is the developer disk image of iOS 17 and later,
+	// which is personalized for each device by Apple's signing server.
+	ImageTypePersonalized ImageType = "Personalized"
+)
+
+// Mount paths of the developer disk images.
+const (
+	DeveloperImageMountPath    = "/Developer"
+	PersonalizedImageMountPath = "/System/Developer"
+)
+
+// personalizedImageType is the PersonalizedImageType of the developer disk
+// image used for nonce and manifest queries.
+const personalizedImageType = "DeveloperDiskImage"
+
+var (
+	// ErrImageMounted is returned when mounting an image while one of the
+	// same type is already mounted.
+	ErrImageMounted = errors.New("image already mounted")
+
+	// ErrImageNotMounted is returned when unmounting an image that is not
+	// mounted.
+	ErrImageNotMounted = errors.New("image not mounted")
+
+	// ErrDeveloperModeDisabled is returned when mounting a developer disk
+	// image on a device which does not have Developer Mode enabled.
+	ErrDeveloperModeDisabled = errors.New("developer mode is not enabled")
+
+	// ErrManifestNotFound is returned by QueryPersonalizationManifest when
+	// the device has no manifest for the image.
+	ErrManifestNotFound = errors.New("personalization manifest not found")
+)
+
+type imageMounterRequest struct {
+	Command               string
+	ImageType             string `plist:",omitempty"`
+	ImageSize             int64  `plist:",omitempty"`
+	ImageSignature        []byte `plist:",omitempty"`
+	ImageTrustCache       []byte `plist:",omitempty"`
+	MountPath             string `plist:",omitempty"`
+	PersonalizedImageType string `plist:",omitempty"`
+}
+
+type imageMounterResponse struct {
+	Status        string
+	Error         string
+	DetailedError string
+
+	// ImageSignature is a list of signatures on recent versions of iOS and
+	// a single one on older versions.
+	ImageSignature interface{}
+	ImagePresent   bool
+
+	PersonalizationNonce       []byte
+	PersonalizationIdentifiers map[string]interface{}
+}
+
+func (r *imageMounterResponse) err() error {
+	if r.Error == "" {
+		return nil
+	}
+	if strings.Contains(r.DetailedError, "Developer mode is not enabled") {
+		return ErrDeveloperModeDisabled
+	}
+	if r.DetailedError != "" {
+		return fmt.Errorf("%s: %s", r.Error, r.DetailedError)
+	}
+	return errors.New(r.Error)
+}
+
+// ImageMounter is a client of com.apple.mobile.mobile_image_mounter, which
+// mounts developer disk images.
+type ImageMounter struct {
+	conn net.Conn
+}
+
+// ImageStatus reports which developer disk images are mounted.
+type ImageStatus struct {
+	Developer    bool
+	Personalized bool
+
+	// Signatures are the signatures, or the manifests for personalized
+	// images, of the mounted images.
+	Signatures [][]byte `json:",omitempty"`
+}
+
+// MountDeveloperImage mounts a developer disk image for iOS 16 and earlier,
+// e.g. DeveloperDiskImage.dmg and DeveloperDiskImage.dmg.signature from
+// Xcode's DeviceSupport directory.
+func MountDeveloperImage(device *Device, imagePath, signaturePath string) error {
+	signature, err := os.ReadFile(signaturePath)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	mounter, err := imageMounterService(device)
+	if err != nil {
+		return err
+	}
+	defer mounter.Close()
+
+	signatures, err := mounter.LookupImage(ImageTypeDeveloper)
+	if err != nil {
+		return err
+	}
+	if len(signatures) > 0 {
+		return ErrImageMounted
+	}
+
+	if err := mounter.UploadImage(ImageTypeDeveloper, f, fi.Size(), signature); err != nil {
+		return fmt.Errorf("upload: %v", err)
+	}
+
+	return mounter.MountImage(ImageTypeDeveloper, signature, nil)
+}
+
+// MountPersonalizedImage mounts a developer disk image for iOS 17 and
+// later. The manifest is taken from the device if it personalized the image
+// before, otherwise it is requested from Apple's signing server for the
+// build identity of buildManifest matching the device.
+func MountPersonalizedImage(device *Device, image, trustCache, buildManifest []byte) error {
+	ecid, err := uniqueChipID(device)
+	if err != nil {
+		return err
+	}
+
+	mounter, err := imageMounterService(device)
+	if err != nil {
+		return err
+	}
+	defer mounter.Close()
+
+	signatures, err := mounter.LookupImage(ImageTypePersonalized)
+	if err != nil {
+		return err
+	}
+	if len(signatures) > 0 {
+		return ErrImageMounted
+	}
+
+	hash := sha512.Sum384(image)
+	manifest, err := mounter.QueryPersonalizationManifest(hash[:])
+	if errors.Is(err, ErrManifestNotFound) {
+		manifest, err = mounter.personalize(ecid, buildManifest)
+	}
+	if err != nil {
+		return fmt.Errorf("manifest: %v", err)
+	}
+
+	if err := mounter.UploadImage(ImageTypePersonalized, bytes.NewReader(image), int64(len(image)), manifest); err != nil {
+		return fmt.Errorf("upload: %v", err)
+	}
+
+	return mounter.MountImage(ImageTypePersonalized, manifest, trustCache)
+}
+
+// ReadPersonalizedImage reads a personalized developer disk image from dir,
+// which is either Xcode's DeveloperDiskImages/iOS_DDI/Restore directory or a
+// directory with Image.dmg, Image.dmg.trustcache and BuildManifest.plist.
+func ReadPersonalizedImage(dir string) (image, trustCache, buildManifest []byte, err error) {
+	buildManifest, err = os.ReadFile(filepath.Join(dir, "BuildManifest.plist"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	manifest := make(map[string]interface{})
+	if _, err := plist.Unmarshal(buildManifest, &manifest); err != nil {
+		return nil, nil, nil, fmt.Errorf("build manifest: %v", err)
+	}
+
+	// the image and trust cache are the same for all build identities
+	imagePath := filepath.Join(dir, "Image.dmg")
+	trustCachePath := imagePath + ".trustcache"
+	if identities, _ := manifest["BuildIdentities"].([]interface{}); len(identities) > 0 {
+		identity, _ := identities[0].(map[string]interface{})
+		items, _ := identity["Manifest"].(map[string]interface{})
+		if p := manifestItemPath(items, "PersonalizedDMG"); p != "" {
+			imagePath = filepath.Join(dir, p)
+		}
+		if p := manifestItemPath(items, "LoadableTrustCache"); p != "" {
+			trustCachePath = filepath.Join(dir, p)
+		}
+	}
+
+	image, err = os.ReadFile(imagePath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	trustCache, err = os.ReadFile(trustCachePath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return image, trustCache, buildManifest, nil
+}
+
+func manifestItemPath(items map[string]interface{}, name string) string {
+	item, _ := items[name].(map[string]interface{})
+	info, _ := item["Info"].(map[string]interface{})
+	p, _ := info["Path"].(string)
+	return p
+}
+
+// UnmountImage unmounts the image mounted at mountPath, which is
+// DeveloperImageMountPath or PersonalizedImageMountPath for developer disk
+// images.
+func UnmountImage(device *Device, mountPath string) error {
+	mounter, err := imageMounterService(device)
+	if err != nil {
+		return err
+	}
+	defer mounter.Close()
+
+	return mounter.UnmountImage(mountPath)
+}
+
+// DeveloperImageStatus reports which developer disk images are mounted.
+func DeveloperImageStatus(device *Device) (*ImageStatus, error) {
+	mounter, err := imageMounterService(device)
+	if err != nil {
+		return nil, err
+	}
+	defer mounter.Close()
+
+	status := &ImageStatus{}
+	for _, t := range []ImageType{ImageTypeDeveloper, ImageTypePersonalized} {
+		signatures, err := mounter.LookupImage(t)
+		if err != nil && t == ImageTypePersonalized {
+			// versions before iOS 17 don't know personalized images
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("lookup %s: %v", t, err)
+		}
+		if len(signatures) == 0 {
+			continue
+		}
+
+		if t == ImageTypeDeveloper {
+			status.Developer = true
+		} else {
+			status.Personalized = true
+		}
+		status.Signatures = append(status.Signatures, signatures...)
+	}
+
+	return status, nil
+}
+
+func imageMounterService(device *Device) (*ImageMounter, error) {
+	lockdown, err := LockdownService(device)
+	if err != nil {
+		return nil, fmt.Errorf("lockdown: %v", err)
+	}
+
+	mounter, err := lockdown.ImageMounterService()
+	if err != nil {
+		return nil, fmt.Errorf("image mounter: %v", err)
+	}
+
+	return mounter, nil
+}
+
+// uniqueChipID returns the ECID of the device, which is only readable
+// within a lockdown session.
+func uniqueChipID(device *Device) (uint64, error) {
+	lockdown, err := LockdownService(device)
+	if err != nil {
+		return 0, fmt.Errorf("lockdown: %v", err)
+	}
+	defer lockdown.Conn().Close()
+
+	pair, err := ReadPairRecord(device)
+	if err != nil {
+		return 0, fmt.Errorf("read pair: %v", err)
+	}
+
+	if err := lockdown.startSession(pair); err != nil {
+		return 0, fmt.Errorf("start session: %v", err)
+	}
+	defer lockdown.stopSession()
+
+	v, err := lockdown.GetValue("", "UniqueChipID")
+	if err != nil {
+		return 0, fmt.Errorf("lockdown: %v", err)
+	}
+
+	ecid, ok := v.(uint64)
+	if !ok {
+		return 0, fmt.Errorf("lockdown: unexpected UniqueChipID of type %T", v)
+	}
+
+	return ecid, nil
+}
+
+// LookupImage returns the signatures of the mounted images of the type. It
+// returns no signatures if none is mounted.
+func (m *ImageMounter) LookupImage(imageType ImageType) ([][]byte, error) {
+	resp, err := m.request(imageMounterRequest{
+		Command:   "LookupImage",
+		ImageType: string(imageType),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signatures := make([][]byte, 0)
+	switch s := resp.ImageSignature.(type) {
+	case []byte:
+		signatures = append(signatures, s)
+	case []interface{}:
+		for _, v := range s {
+			if b, ok := v.([]byte); ok {
+				signatures = append(signatures, b)
+			}
+		}
+	}
+
+	// versions before iOS 7 only report whether an image is present
+	if len(signatures) == 0 && resp.ImagePresent {
+		signatures = append(signatures, []byte{})
+	}
+
+	return signatures, nil
+}
+
+// UploadImage sends the image to the device with ReceiveBytes. The image is
+// mounted with MountImage afterwards.
+func (m *ImageMounter) UploadImage(imageType ImageType, r io.Reader, size int64, signature []byte) error {
+	resp, err := m.request(imageMounterRequest{
+		Command:        "ReceiveBytes",
+		ImageType:      string(imageType),
+		ImageSize:      size,
+		ImageSignature: signature,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Status != "ReceiveBytesAck" {
+		return fmt.Errorf("receive bytes: unexpected status %q", resp.Status)
+	}
+
+	if _, err := io.CopyN(m.conn, r, size); err != nil {
+		return err
+	}
+
+	resp = &imageMounterResponse{}
+	if err := receivePlist(m.conn, resp); err != nil {
+		return err
+	}
+	if err := resp.err(); err != nil {
+		return err
+	}
+	if resp.Status != "Complete" {
+		return fmt.Errorf("receive bytes: unexpected status %q", resp.Status)
+	}
+
+	return nil
+}
+
+// MountImage mounts the uploaded image. Personalized images also require
+// their trust cache, it is nil for other images.
+func (m *ImageMounter) MountImage(imageType ImageType, signature, trustCache []byte) error {
+	resp, err := m.request(imageMounterRequest{
+		Command:         "MountImage",
+		ImageType:       string(imageType),
+		ImageSignature:  signature,
+		ImageTrustCache: trustCache,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Status != "Complete" {
+		return fmt.Errorf("mount image: unexpected status %q", resp.Status)
+	}
+
+	return nil
+}
+
+// UnmountImage unmounts the image mounted at mountPath.
+func (m *ImageMounter) UnmountImage(mountPath string) error {
+	_, err := m.request(imageMounterRequest{
+		Command:   "UnmountImage",
+		MountPath: mountPath,
+	})
+	if err != nil && strings.Contains(err.Error(), "There is no matching entry in the device map") {
+		return ErrImageNotMounted
+	}
+	return err
+}
+
+// QueryNonce returns the nonce personalized images are signed with.
+func (m *ImageMounter) QueryNonce() ([]byte, error) {
+	resp, err := m.request(imageMounterRequest{
+		Command:               "QueryNonce",
+		PersonalizedImageType: personalizedImageType,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.PersonalizationNonce, nil
+}
+
+// QueryPersonalizationIdentifiers returns the identifiers of the device
+// required to personalize images, like BoardId and ChipID.
+func (m *ImageMounter) QueryPersonalizationIdentifiers() (map[string]interface{}, error) {
+	resp, err := m.request(imageMounterRequest{
+		Command:               "QueryPersonalizationIdentifiers",
+		PersonalizedImageType: personalizedImageType,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.PersonalizationIdentifiers, nil
+}
+
+// QueryPersonalizationManifest returns the manifest of an image the device
+// personalized before, identified by its SHA-384 hash. It returns
+// ErrManifestNotFound if there is none.
+func (m *ImageMounter) QueryPersonalizationManifest(imageHash []byte) ([]byte, error) {
+	req := imageMounterRequest{
+		Command:               "QueryPersonalizationManifest",
+		PersonalizedImageType: personalizedImageType,
+		ImageType:             personalizedImageType,
+		ImageSignature:        imageHash,
+	}
+	if err := sendPlist(m.conn, req); err != nil {
+		return nil, err
+	}
+
+	resp := &imageMounterResponse{}
+	if err := receivePlist(m.conn, resp); err != nil {
+		return nil, err
+	}
+
+	// the device responds with an error if it never personalized the image
+	manifest, ok := resp.ImageSignature.([]byte)
+	if resp.Error != "" || !ok {
+		return nil, ErrManifestNotFound
+	}
+
+	return manifest, nil
+}
+
+// Close hangs up and closes the connection.
+func (m *ImageMounter) Close() error {
+	err := sendPlist(m.conn, imageMounterRequest{Command: "Hangup"})
+	if err == nil {
+		// the service acknowledges the hangup before closing
+		receivePlist(m.conn, &imageMounterResponse{})
+	}
+	if cerr := m.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// personalize requests a manifest for the image from Apple's signing
+// server.
+func (m *ImageMounter) personalize(ecid uint64, buildManifest []byte) ([]byte, error) {
+	manifest := make(map[string]interface{})
+	if _, err := plist.Unmarshal(buildManifest, &manifest); err != nil {
+		return nil, fmt.Errorf("build manifest: %v", err)
+	}
+
+	identifiers, err := m.QueryPersonalizationIdentifiers()
+	if err != nil {
+		return nil, fmt.Errorf("personalization identifiers: %v", err)
+	}
+
+	identity, err := buildIdentity(manifest, identifiers)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := m.QueryNonce()
+	if err != nil {
+		return nil, fmt.Errorf("nonce: %v", err)
+	}
+
+	return personalizationManifest(identity, &personalizationRequest{
+		identifiers: identifiers,
+		ecid:        ecid,
+		nonce:       nonce,
+	})
+}
+
+func (m *ImageMounter) request(req imageMounterRequest) (*imageMounterResponse, error) {
+	if err := sendPlist(m.conn, req); err != nil {
+		return nil, err
+	}
+
+	resp := &imageMounterResponse{}
+	if err := receivePlist(m.conn, resp); err != nil {
+		return nil, err
+	}
+
+	if err := resp.err(); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,85 @@
+package infoplist
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+
+	"howett.net/plist"
+)
+
+// nestedBundlePatterns are the locations of bundles nested inside another
+// bundle, relative to it.
+var nestedBundlePatterns = []string{
+	"Frameworks/*.framework",
+	"PlugIns/*.appex",
+	"Extensions/*.appex",
+	"Watch/*.app",
+}
+
+// Bundle is an application bundle together with the frameworks, app
+// extensions and watch apps nested in it.
+type Bundle struct {
+	// Path is the location of the bundle inside the IPA file or .app
+	// directory, e.g. "Payload/Example.app/PlugIns/Widget.appex".
+	Path string
+
+	// Info is the Info.plist of the bundle. It is empty when the bundle does
+	// not have one.
+	Info Info
+
+	// Bundles are the bundles nested directly inside of this one.
+	Bundles []*Bundle
+}
+
+// Bundles returns the bundle tree of the specified IPA file or unpacked .app
+// directory, starting with the main application.
+func Bundles(filename string) (*Bundle, error) {
+	pkg, err := Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer pkg.Close()
+
+	return pkg.Bundles()
+}
+
+// Bundles returns the bundle tree of the package, starting with the main
+// application.
+func (p *Package) Bundles() (*Bundle, error) {
+	return readBundle(p.fsys, p.appDir)
+}
+
+func readBundle(fsys fs.FS, dir string) (*Bundle, error) {
+	b := &Bundle{
+		Path: dir,
+		Info: make(Info, 0),
+	}
+
+	data, err := fs.ReadFile(fsys, path.Join(dir, "Info.plist"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if _, err := plist.Unmarshal(data, &b.Info); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, pattern := range nestedBundlePatterns {
+		matches, err := fs.Glob(fsys, path.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range matches {
+			nested, err := readBundle(fsys, m)
+			if err != nil {
+				return nil, err
+			}
+			b.Bundles = append(b.Bundles, nested)
+		}
+	}
+
+	return b, nil
+}
@@ -0,0 +1,144 @@
+package infoplist
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+var (
+	ErrRangeNotSupported = errors.New("server does not support range requests")
+)
+
+// httpBlockSize is the minimum amount of data requested at once. Reading a
+// zip file issues many small reads around the same offsets, so reading ahead
+// saves a lot of round trips.
+const httpBlockSize = 1 << 20
+
+// HTTPReaderAt reads a remote file with HTTP range requests. Together with
+// NewReader, StatReaderAt or VerifyReaderAt it allows inspecting an IPA in
+// remote storage without downloading all of it.
+type HTTPReaderAt struct {
+	client *http.Client
+	url    string
+	size   int64
+
+	mu sync.Mutex
+
+	// block holds the most recently fetched data, which starts at
+	// blockOffset.
+	block       []byte
+	blockOffset int64
+}
+
+// NewHTTPReaderAt returns a reader for the file at url. The size of the file
+// is determined with a HEAD request. client may be nil, in which case
+// http.DefaultClient is used.
+func NewHTTPReaderAt(client *http.Client, url string) (*HTTPReaderAt, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Head(url)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("head %s: %s", url, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("head %s: unknown content length", url)
+	}
+	if resp.Header.Get("Accept-Ranges") == "none" {
+		return nil, ErrRangeNotSupported
+	}
+
+	return &HTTPReaderAt{
+		client: client,
+		url:    url,
+		size:   resp.ContentLength,
+	}, nil
+}
+
+// Size returns the size of the remote file in bytes.
+func (r *HTTPReaderAt) Size() int64 {
+	return r.size
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *HTTPReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for n < len(p) && off < r.size {
+		if off < r.blockOffset || off >= r.blockOffset+int64(len(r.block)) {
+			length := int64(len(p) - n)
+			if length < httpBlockSize {
+				length = httpBlockSize
+			}
+			if err := r.fetch(off, length); err != nil {
+				return n, err
+			}
+		}
+
+		c := copy(p[n:], r.block[off-r.blockOffset:])
+		n += c
+		off += int64(c)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// fetch replaces the cached block with length bytes starting at off.
+func (r *HTTPReaderAt) fetch(off, length int64) error {
+	if off+length > r.size {
+		length = r.size - off
+	}
+
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range and is sending the whole file
+		return ErrRangeNotSupported
+	default:
+		return fmt.Errorf("get %s: %s", r.url, resp.Status)
+	}
+
+	block := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, block); err != nil {
+		return fmt.Errorf("get %s: %v", r.url, err)
+	}
+
+	r.block = block
+	r.blockOffset = off
+
+	return nil
+}
@@ -0,0 +1,263 @@
+package infoplist
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+var (
+	ErrNoIcon = errors.New("application does not have an icon")
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// Icon returns the application icon whose width is closest to, but not
+// smaller than size. The largest icon is returned when none of them is big
+// enough, or when size is zero.
+//
+// Icons are resolved through CFBundleIcons, CFBundleIcons~ipad,
+// CFBundleIconFiles and CFBundleIconFile. Icons that only exist in an asset
+// catalog are not supported.
+func Icon(filename string, size int) (image.Image, error) {
+	pkg, err := Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer pkg.Close()
+
+	return pkg.Icon(size)
+}
+
+// Icon returns the application icon closest to size, see Icon.
+func (p *Package) Icon(size int) (image.Image, error) {
+	info, err := p.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	var best image.Image
+	for _, iconPath := range iconPaths(p.fsys, p.appDir, info) {
+		f, err := p.fsys.Open(iconPath)
+		if err != nil {
+			return nil, err
+		}
+
+		img, err := DecodePNG(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", iconPath, err)
+		}
+
+		if best == nil || betterIcon(img, best, size) {
+			best = img
+		}
+	}
+
+	if best == nil {
+		return nil, ErrNoIcon
+	}
+
+	return best, nil
+}
+
+// betterIcon reports whether icon a is a better match for size than b.
+func betterIcon(a, b image.Image, size int) bool {
+	aw, bw := a.Bounds().Dx(), b.Bounds().Dx()
+
+	if size <= 0 {
+		return aw > bw
+	}
+
+	switch {
+	case aw >= size && bw >= size:
+		return aw < bw
+	case aw >= size:
+		return true
+	case bw >= size:
+		return false
+	default:
+		return aw > bw
+	}
+}
+
+// iconPaths returns the paths of all icon files referenced by the Info.plist.
+// Icon names usually omit the extension and the @2x, @3x or ~ipad suffixes.
+func iconPaths(fsys fs.FS, appDir string, info Info) []string {
+	names := make([]string, 0)
+	for _, key := range []string{"CFBundleIcons", "CFBundleIcons~ipad"} {
+		icons, _ := info[key].(map[string]interface{})
+		primary, _ := icons["CFBundlePrimaryIcon"].(map[string]interface{})
+		names = append(names, stringValues(primary["CFBundleIconFiles"])...)
+	}
+	names = append(names, stringValues(info["CFBundleIconFiles"])...)
+	names = append(names, stringValues(info["CFBundleIconFile"])...)
+
+	seen := make(map[string]bool)
+	paths := make([]string, 0)
+	for _, name := range names {
+		pattern := path.Join(appDir, name)
+		if !strings.HasSuffix(strings.ToLower(name), ".png") {
+			pattern += "*.png"
+		}
+
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			continue
+		}
+
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				paths = append(paths, m)
+			}
+		}
+	}
+
+	return paths
+}
+
+// stringValues returns v as a list of strings, whether it is a single string
+// or an array of them.
+func stringValues(v interface{}) []string {
+	switch s := v.(type) {
+	case string:
+		return []string{s}
+	case []interface{}:
+		values := make([]string, 0, len(s))
+		for _, i := range s {
+			if str, ok := i.(string); ok {
+				values = append(values, str)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// DecodePNG decodes a PNG image, including the CgBI variant Xcode produces
+// when it optimises the PNGs of an iOS application.
+//
+// CgBI images have an extra CgBI chunk before IHDR, store the image data as a
+// raw deflate stream without the zlib header and checksum, and use
+// premultiplied BGRA pixels instead of RGBA.
+func DecodePNG(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, fmt.Errorf("not a png image")
+	}
+
+	var ihdr, idat []byte
+	cgbi, iend := false, false
+	for b := data[len(pngSignature):]; !iend; {
+		if len(b) < 12 {
+			return nil, fmt.Errorf("truncated png chunk")
+		}
+		length := binary.BigEndian.Uint32(b)
+		if uint64(length)+12 > uint64(len(b)) {
+			return nil, fmt.Errorf("truncated png chunk")
+		}
+		chunkType := string(b[4:8])
+		chunkData := b[8 : 8+length]
+		b = b[12+length:]
+
+		switch chunkType {
+		case "CgBI":
+			cgbi = true
+		case "IHDR":
+			ihdr = chunkData
+		case "IDAT":
+			idat = append(idat, chunkData...)
+		case "IEND":
+			iend = true
+		}
+	}
+
+	if !cgbi {
+		return png.Decode(bytes.NewReader(data))
+	}
+
+	raw, err := io.ReadAll(flate.NewReader(bytes.NewReader(idat)))
+	if err != nil {
+		return nil, fmt.Errorf("inflate: %v", err)
+	}
+
+	compressed := &bytes.Buffer{}
+	zw := zlib.NewWriter(compressed)
+	if _, err := zw.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	// rebuild a standard png and let image/png deal with filtering and
+	// interlacing
+	buf := &bytes.Buffer{}
+	buf.Write(pngSignature)
+	writeChunk(buf, "IHDR", ihdr)
+	writeChunk(buf, "IDAT", compressed.Bytes())
+	writeChunk(buf, "IEND", nil)
+
+	img, err := png.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	switch m := img.(type) {
+	case *image.NRGBA:
+		for i := 0; i+3 < len(m.Pix); i += 4 {
+			b, g, r, a := m.Pix[i], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3]
+			if a != 0 && a != 0xff {
+				r, g, b = unpremultiply(r, a), unpremultiply(g, a), unpremultiply(b, a)
+			}
+			m.Pix[i], m.Pix[i+1], m.Pix[i+2] = r, g, b
+		}
+	case *image.RGBA:
+		// no alpha channel, so there is nothing to un-premultiply
+		for i := 0; i+3 < len(m.Pix); i += 4 {
+			m.Pix[i], m.Pix[i+2] = m.Pix[i+2], m.Pix[i]
+		}
+	}
+
+	return img, nil
+}
+
+func unpremultiply(c, a uint8) uint8 {
+	v := uint32(c) * 0xff / uint32(a)
+	if v > 0xff {
+		v = 0xff
+	}
+	return uint8(v)
+}
+
+func writeChunk(w io.Writer, chunkType string, data []byte) {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	copy(header[4:], chunkType)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+
+	footer := make([]byte, 4)
+	binary.BigEndian.PutUint32(footer, crc.Sum32())
+
+	w.Write(header)
+	w.Write(data)
+	w.Write(footer)
+}
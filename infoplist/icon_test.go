@@ -0,0 +1,144 @@
+package infoplist
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// cgbiPNG encodes rows of raw pixels like Xcode's pngcrush does: a CgBI chunk
+// before IHDR and the image data as a raw deflate stream.
+func cgbiPNG(t *testing.T, width, height int, colorType byte, rows [][]byte) []byte {
+	t.Helper()
+
+	raw := &bytes.Buffer{}
+	for _, row := range rows {
+		raw.WriteByte(0) // no filter
+		raw.Write(row)
+	}
+
+	idat := &bytes.Buffer{}
+	fw, err := flate.NewWriter(idat, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(raw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr, uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(height))
+	ihdr[8] = 8
+	ihdr[9] = colorType
+
+	buf := &bytes.Buffer{}
+	buf.Write(pngSignature)
+	writeChunk(buf, "CgBI", []byte{0x50, 0x00, 0x20, 0x06})
+	writeChunk(buf, "IHDR", ihdr)
+	writeChunk(buf, "IDAT", idat.Bytes())
+	writeChunk(buf, "IEND", nil)
+
+	return buf.Bytes()
+}
+
+func TestDecodePNGCgBI(t *testing.T) {
+	// premultiplied BGRA
+	data := cgbiPNG(t, 2, 2, 6, [][]byte{
+		{0x00, 0x00, 0xff, 0xff /**/, 0x40, 0x20, 0x10, 0x80},
+		{0x00, 0x00, 0x00, 0x00 /**/, 0x33, 0x66, 0x99, 0xff},
+	})
+
+	img, err := DecodePNG(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[image.Point]color.NRGBA{
+		{0, 0}: {0xff, 0x00, 0x00, 0xff},
+		{1, 0}: {0x1f, 0x3f, 0x7f, 0x80},
+		{0, 1}: {0x00, 0x00, 0x00, 0x00},
+		{1, 1}: {0x99, 0x66, 0x33, 0xff},
+	}
+	for p, c := range want {
+		if got := color.NRGBAModel.Convert(img.At(p.X, p.Y)); got != c {
+			t.Errorf("pixel %v = %v, want %v", p, got, c)
+		}
+	}
+}
+
+func TestDecodePNGCgBIWithoutAlpha(t *testing.T) {
+	// BGR
+	data := cgbiPNG(t, 2, 1, 2, [][]byte{
+		{0x00, 0x00, 0xff /**/, 0x33, 0x66, 0x99},
+	})
+
+	img, err := DecodePNG(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for p, c := range map[image.Point]color.NRGBA{
+		{0, 0}: {0xff, 0x00, 0x00, 0xff},
+		{1, 0}: {0x99, 0x66, 0x33, 0xff},
+	} {
+		if got := color.NRGBAModel.Convert(img.At(p.X, p.Y)); got != c {
+			t.Errorf("pixel %v = %v, want %v", p, got, c)
+		}
+	}
+}
+
+func TestDecodePNGStandard(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	src.Set(0, 0, color.NRGBA{0x10, 0x20, 0x30, 0x80})
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := DecodePNG(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := color.NRGBAModel.Convert(img.At(0, 0)), (color.NRGBA{0x10, 0x20, 0x30, 0x80}); got != want {
+		t.Errorf("pixel = %v, want %v", got, want)
+	}
+}
+
+func TestDecodePNGTruncated(t *testing.T) {
+	data := cgbiPNG(t, 2, 2, 6, [][]byte{
+		{0x00, 0x00, 0xff, 0xff, 0x40, 0x20, 0x10, 0x80},
+		{0x00, 0x00, 0x00, 0x00, 0x33, 0x66, 0x99, 0xff},
+	})
+
+	// every truncation has to fail rather than panic or return a partial
+	// image
+	for i := 0; i < len(data); i++ {
+		if _, err := DecodePNG(bytes.NewReader(data[:i])); err == nil {
+			t.Errorf("truncated to %d bytes: expected an error", i)
+		}
+	}
+
+	// a chunk length pointing past the end of the file
+	corrupt := append([]byte{}, data...)
+	binary.BigEndian.PutUint32(corrupt[len(pngSignature):], 0xffffffff)
+	if _, err := DecodePNG(bytes.NewReader(corrupt)); err == nil {
+		t.Error("oversized chunk length: expected an error")
+	}
+
+	// image data that is cut short inside of the deflate stream
+	short := cgbiPNG(t, 2, 2, 6, [][]byte{
+		{0x00, 0x00, 0xff, 0xff, 0x40, 0x20, 0x10, 0x80},
+	})
+	if _, err := DecodePNG(bytes.NewReader(short)); err == nil {
+		t.Error("missing row: expected an error")
+	}
+}
@@ -2,55 +2,380 @@ package infoplist
 
 import (
 	"archive/zip"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
 	"path"
+	"sort"
+	"strconv"
+	"sync"
 
 	"howett.net/plist"
 )
 
 const (
-	PlistKeyBundleExecutable         = "CFBundleName"
-	PlistKeyBundleIdentifier         = "CFBundleIdentifier"
-	PlistKeyBundleShortVersionString = "CFBundleShortVersionString"
+	PlistKeyBundleExecutable           = "CFBundleExecutable"
+	PlistKeyBundleName                 = "CFBundleName"
+	PlistKeyBundleDisplayName          = "CFBundleDisplayName"
+	PlistKeyDevelopmentRegion          = "CFBundleDevelopmentRegion"
+	PlistKeyBundleIdentifier           = "CFBundleIdentifier"
+	PlistKeyBundleShortVersionString   = "CFBundleShortVersionString"
+	PlistKeyBundleVersion              = "CFBundleVersion"
+	PlistKeyRequiredDeviceCapabilities = "UIRequiredDeviceCapabilities"
+	PlistKeyMinimumOSVersion           = "MinimumOSVersion"
+	PlistKeyDeviceFamily               = "UIDeviceFamily"
 )
 
-// Stat returns the Info.plist metadata for the specified IPA file.
-func Stat(filename string) (map[string]interface{}, error) {
-	zf, err := zip.OpenReader(filename)
+// Device families listed in UIDeviceFamily.
+const (
+	DeviceFamilyiPhone  = 1
+	DeviceFamilyiPad    = 2
+	DeviceFamilyAppleTV = 3
+	DeviceFamilyWatch   = 4
+)
+
+// Info is the contents of an Info.plist file.
+type Info map[string]interface{}
+
+// MinimumOSVersion returns the lowest OS version the application runs on,
+// or an empty string when it is not specified.
+func (i Info) MinimumOSVersion() string {
+	v, _ := i[PlistKeyMinimumOSVersion].(string)
+	return v
+}
+
+// DeviceFamily returns the device families the application supports. Apps
+// without UIDeviceFamily only support the iPhone family.
+func (i Info) DeviceFamily() []int {
+	families := make([]int, 0)
+
+	values, ok := i[PlistKeyDeviceFamily].([]interface{})
+	if !ok {
+		values = []interface{}{i[PlistKeyDeviceFamily]}
+	}
+
+	for _, v := range values {
+		switch f := v.(type) {
+		case uint64:
+			families = append(families, int(f))
+		case int64:
+			families = append(families, int(f))
+		case string:
+			if n, err := strconv.Atoi(f); err == nil {
+				families = append(families, n)
+			}
+		}
+	}
+
+	if len(families) == 0 {
+		families = append(families, DeviceFamilyiPhone)
+	}
+
+	return families
+}
+
+// RequiredDeviceCapabilities returns the device capabilities the application
+// requires, e.g. "arm64" or "metal".
+//
+// UIRequiredDeviceCapabilities is either an array of required capabilities
+// or a dictionary where true marks a capability as required and false as one
+// that must not be present. Only the required ones are returned.
+func (i Info) RequiredDeviceCapabilities() []string {
+	capabilities := make([]string, 0)
+
+	switch v := i[PlistKeyRequiredDeviceCapabilities].(type) {
+	case []interface{}:
+		for _, c := range v {
+			if s, ok := c.(string); ok {
+				capabilities = append(capabilities, s)
+			}
+		}
+	case map[string]interface{}:
+		for c, required := range v {
+			if b, ok := required.(bool); ok && b {
+				capabilities = append(capabilities, c)
+			}
+		}
+		sort.Strings(capabilities)
+	}
+
+	return capabilities
+}
+
+// Stat returns the Info.plist metadata for the specified IPA file or
+// unpacked .app directory.
+func Stat(filename string) (Info, error) {
+	pkg, err := Open(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer zf.Close()
+	defer pkg.Close()
 
-	for _, file := range zf.File {
-		matched, err := path.Match("Payload/*.app/Info.plist", file.Name)
+	return pkg.Info()
+}
+
+// StatReaderAt returns the Info.plist metadata of the IPA read from r, which
+// is size bytes long.
+func StatReaderAt(r io.ReaderAt, size int64) (Info, error) {
+	pkg, err := NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	defer pkg.Close()
+
+	return pkg.Info()
+}
+
+// ReadFile returns the contents of the named file inside the application
+// bundle of the specified IPA file or unpacked .app directory. name is
+// relative to the bundle, e.g. "embedded.mobileprovision".
+func ReadFile(filename, name string) ([]byte, error) {
+	pkg, err := Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer pkg.Close()
+
+	return pkg.ReadFile(name)
+}
+
+// Package is an IPA file or an unpacked .app directory.
+type Package struct {
+	fsys fs.FS
+
+	// appDir is the directory of the application bundle inside fsys.
+	appDir string
+
+	// zr and r are the zip directory and contents of an IPA. They are nil
+	// for directories.
+	zr *zip.Reader
+	r  io.ReaderAt
+
+	closer io.Closer
+}
+
+// Open opens the IPA file or unpacked .app directory.
+func Open(filename string) (*Package, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return &Package{fsys: os.DirFS(filename), appDir: "."}, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg, err := NewReader(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	pkg.closer = f
+
+	return pkg, nil
+}
+
+// NewReader opens the IPA read from r, which is size bytes long. Only the
+// zip directory and the files that are accessed are read, which makes it
+// suitable for inspecting IPAs in remote storage, see HTTPReaderAt.
+func NewReader(r io.ReaderAt, size int64) (*Package, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	appDir, err := findApp(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Package{fsys: zr, appDir: appDir, zr: zr, r: r}, nil
+}
+
+// Close releases the underlying file, if any.
+func (p *Package) Close() error {
+	if p.closer == nil {
+		return nil
+	}
+	return p.closer.Close()
+}
+
+// ReadFile returns the contents of the named file relative to the
+// application bundle.
+func (p *Package) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(p.fsys, path.Join(p.appDir, name))
+}
+
+// ReadAtCloser is a file opened for random access.
+type ReadAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// OpenReaderAt opens the named file relative to the application bundle for
+// random access and returns it together with its size. Unlike ReadFile, only
+// the parts of the file that are read are fetched, which matters for large
+// executables in an IPA read with HTTP range requests.
+//
+// Files stored uncompressed in an IPA, and the files of a directory, are
+// read in place. Compressed files can only be inflated from the start, so
+// they are inflated up to the furthest offset read.
+func (p *Package) OpenReaderAt(name string) (ReadAtCloser, int64, error) {
+	name = path.Join(p.appDir, name)
+
+	if p.zr == nil {
+		f, err := p.fsys.Open(name)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		if r, ok := f.(ReadAtCloser); ok {
+			return r, fi.Size(), nil
+		}
+		f.Close()
+
+		data, err := fs.ReadFile(p.fsys, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		return nopCloser{bytes.NewReader(data)}, int64(len(data)), nil
+	}
 
-		if !matched {
+	for _, zf := range p.zr.File {
+		if zf.Name != name {
 			continue
 		}
 
-		f, err := file.Open()
+		size := int64(zf.UncompressedSize64)
+		if zf.Method == zip.Store {
+			offset, err := zf.DataOffset()
+			if err != nil {
+				return nil, 0, err
+			}
+			return nopCloser{io.NewSectionReader(p.r, offset, size)}, size, nil
+		}
+
+		rc, err := zf.Open()
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		defer f.Close()
+		return &inflatingReaderAt{rc: rc, size: size}, size, nil
+	}
+
+	return nil, 0, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+type nopCloser struct {
+	io.ReaderAt
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
 
-		bytes, err := io.ReadAll(f)
+// inflatingReaderAt provides random access to a compressed zip entry by
+// inflating it as far as it has been read and keeping the result.
+type inflatingReaderAt struct {
+	rc   io.ReadCloser
+	size int64
+
+	mu   sync.Mutex
+	data []byte
+	err  error
+}
+
+func (r *inflatingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	end := off + int64(len(b))
+	if end > r.size {
+		end = r.size
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for int64(len(r.data)) < end && r.err == nil {
+		chunk := make([]byte, end-int64(len(r.data)))
+		n, err := io.ReadFull(r.rc, chunk)
+		r.data = append(r.data, chunk[:n]...)
 		if err != nil {
-			return nil, err
+			r.err = err
 		}
+	}
 
-		data := make(map[string]interface{}, 0)
-		if _, err := plist.Unmarshal(bytes, &data); err != nil {
-			return nil, err
+	if int64(len(r.data)) < end {
+		if r.err == io.EOF || r.err == io.ErrUnexpectedEOF {
+			return 0, io.ErrUnexpectedEOF
 		}
+		return 0, r.err
+	}
 
-		return data, nil
+	n := copy(b, r.data[off:end])
+	if n < len(b) {
+		return n, io.EOF
 	}
+	return n, nil
+}
 
-	return nil, fmt.Errorf("missing Info.plist")
+func (r *inflatingReaderAt) Close() error {
+	return r.rc.Close()
+}
+
+// Info returns the Info.plist of the application.
+func (p *Package) Info() (Info, error) {
+	bytes, err := p.ReadFile("Info.plist")
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(Info, 0)
+	if _, err := plist.Unmarshal(bytes, &data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// findApp returns the directory of the application bundle inside an IPA.
+func findApp(zr *zip.Reader) (string, error) {
+	// only consider the Info.plist at the root of the application, nested
+	// bundles have their own
+	appDirs := make([]string, 0, 1)
+	for _, file := range zr.File {
+		matched, err := path.Match("Payload/*.app/Info.plist", file.Name)
+		if err != nil {
+			return "", err
+		}
+
+		if matched {
+			appDirs = append(appDirs, path.Dir(file.Name))
+		}
+	}
+
+	switch len(appDirs) {
+	case 0:
+		return "", fmt.Errorf("missing Info.plist")
+	case 1:
+		return appDirs[0], nil
+	default:
+		return "", fmt.Errorf("multiple applications in Payload")
+	}
 }
@@ -0,0 +1,128 @@
+package infoplist
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countingReaderAt records how many bytes are read from it.
+type countingReaderAt struct {
+	r    io.ReaderAt
+	read int64
+}
+
+func (c *countingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(b, off)
+	c.read += int64(n)
+	return n, err
+}
+
+func TestOpenReaderAt(t *testing.T) {
+	executable := make([]byte, 1<<20)
+	for i := range executable {
+		executable[i] = byte(i * 31 / 7)
+	}
+	info := mustPlist(t, map[string]interface{}{"CFBundleExecutable": "Test"})
+
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		buf := &bytes.Buffer{}
+		zw := zip.NewWriter(buf)
+		for name, data := range map[string][]byte{
+			"Payload/Test.app/Info.plist": info,
+			"Payload/Test.app/Test":       executable,
+		} {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(data)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		counter := &countingReaderAt{r: bytes.NewReader(buf.Bytes())}
+		pkg, err := NewReader(counter, int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, size, err := pkg.OpenReaderAt("Test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(executable)) {
+			t.Errorf("method %d: size = %d, want %d", method, size, len(executable))
+		}
+
+		before := counter.read
+		b := make([]byte, 64)
+		if _, err := r.ReadAt(b, 1024); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, executable[1024:1088]) {
+			t.Errorf("method %d: read wrong data", method)
+		}
+		if method == zip.Store && counter.read-before > 64 {
+			t.Errorf("stored entry: read %d bytes for 64", counter.read-before)
+		}
+
+		// reading backwards after reading further ahead
+		if _, err := r.ReadAt(b, int64(len(executable))-64); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, executable[len(executable)-64:]) {
+			t.Errorf("method %d: read wrong data at the end", method)
+		}
+		if _, err := r.ReadAt(b, 0); err != nil || !bytes.Equal(b, executable[:64]) {
+			t.Errorf("method %d: read wrong data at the start: %v", method, err)
+		}
+
+		if n, err := r.ReadAt(b, int64(len(executable))-10); n != 10 || err != io.EOF {
+			t.Errorf("method %d: read past the end = %d, %v, want 10, EOF", method, n, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Error(err)
+		}
+
+		if _, _, err := pkg.OpenReaderAt("Missing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("method %d: missing file: err = %v", method, err)
+		}
+	}
+}
+
+func TestOpenReaderAtDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Test.app")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Test"), []byte("executable"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pkg.Close()
+
+	r, size, err := pkg.OpenReaderAt("Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	b := make([]byte, size)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "executable" {
+		t.Errorf("contents = %q", b)
+	}
+}
@@ -0,0 +1,350 @@
+package infoplist
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"howett.net/plist"
+)
+
+var (
+	ErrNoProvisioningProfile = errors.New("missing embedded.mobileprovision")
+)
+
+// oidSignedData is the DER encoded 1.2.840.113549.1.7.2 object identifier.
+var oidSignedData = []byte{0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x07, 0x02}
+
+// ProvisioningProfile is the provisioning profile embedded in an application
+// bundle as embedded.mobileprovision.
+type ProvisioningProfile struct {
+	AppIDName                   string
+	ApplicationIdentifierPrefix []string
+	CreationDate                time.Time
+	ExpirationDate              time.Time
+	Name                        string
+	Platform                    []string
+	TeamIdentifier              []string
+	TeamName                    string
+	UUID                        string
+	Version                     int
+	TimeToLive                  int
+	ProvisionedDevices          []string
+	ProvisionsAllDevices        bool
+	Entitlements                map[string]interface{}
+	DeveloperCertificates       [][]byte
+}
+
+// TeamID returns the identifier of the team the profile belongs to.
+func (p *ProvisioningProfile) TeamID() string {
+	if len(p.TeamIdentifier) == 0 {
+		return ""
+	}
+	return p.TeamIdentifier[0]
+}
+
+// AppID returns the application identifier the profile was issued for,
+// e.g. "ABCDE12345.com.example.app" or "ABCDE12345.*".
+func (p *ProvisioningProfile) AppID() string {
+	appID, _ := p.Entitlements["application-identifier"].(string)
+	return appID
+}
+
+// Expired reports whether the profile has expired.
+func (p *ProvisioningProfile) Expired() bool {
+	return time.Now().After(p.ExpirationDate)
+}
+
+// IsProvisioned reports whether the device with the given UDID may run
+// applications signed with the profile. Enterprise profiles provision all
+// devices.
+func (p *ProvisioningProfile) IsProvisioned(udid string) bool {
+	if p.ProvisionsAllDevices {
+		return true
+	}
+	for _, d := range p.ProvisionedDevices {
+		if strings.EqualFold(d, udid) {
+			return true
+		}
+	}
+	return false
+}
+
+// Certificates parses the developer certificates included in the profile.
+func (p *ProvisioningProfile) Certificates() ([]*x509.Certificate, error) {
+	certs := make([]*x509.Certificate, 0, len(p.DeveloperCertificates))
+	for _, der := range p.DeveloperCertificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// ReadProvisioningProfile returns the embedded.mobileprovision of the
+// specified IPA file or unpacked .app directory. ErrNoProvisioningProfile is
+// returned when the application does not have one, e.g. App Store builds.
+func ReadProvisioningProfile(filename string) (*ProvisioningProfile, error) {
+	pkg, err := Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer pkg.Close()
+
+	return pkg.ProvisioningProfile()
+}
+
+// ProvisioningProfile returns the embedded.mobileprovision of the
+// application, or ErrNoProvisioningProfile when it does not have one.
+func (p *Package) ProvisioningProfile() (*ProvisioningProfile, error) {
+	data, err := p.ReadFile("embedded.mobileprovision")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNoProvisioningProfile
+		}
+		return nil, err
+	}
+
+	return ParseProvisioningProfile(data)
+}
+
+// ParseProvisioningProfile decodes a .mobileprovision file.
+//
+// The profile is a plist wrapped in a CMS (PKCS#7) SignedData envelope. The
+// signature is not verified.
+func ParseProvisioningProfile(data []byte) (*ProvisioningProfile, error) {
+	content, err := signedDataContent(data)
+	if err != nil {
+		return nil, fmt.Errorf("provisioning profile: %v", err)
+	}
+
+	profile := &ProvisioningProfile{}
+	if _, err := plist.Unmarshal(content, profile); err != nil {
+		return nil, fmt.Errorf("provisioning profile: %v", err)
+	}
+
+	return profile, nil
+}
+
+// signedDataContent returns the encapsulated content of a CMS SignedData
+// structure.
+//
+//	ContentInfo ::= SEQUENCE {
+//	  contentType OBJECT IDENTIFIER,
+//	  content [0] EXPLICIT SignedData }
+//
+//	SignedData ::= SEQUENCE {
+//	  version INTEGER,
+//	  digestAlgorithms SET OF AlgorithmIdentifier,
+//	  encapContentInfo SEQUENCE {
+//	    eContentType OBJECT IDENTIFIER,
+//	    eContent [0] EXPLICIT OCTET STRING OPTIONAL },
+//	  ... }
+//
+// Profiles are BER rather than DER encoded, so encoding/asn1 can not be used.
+func signedDataContent(data []byte) ([]byte, error) {
+	contentInfo, _, err := parseBER(data, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := contentInfo.children()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) < 2 || !bytes.Equal(fields[0].content, oidSignedData) {
+		return nil, fmt.Errorf("not a cms signed data structure")
+	}
+
+	signedData, err := fields[1].child(0)
+	if err != nil {
+		return nil, err
+	}
+
+	encapContentInfo, err := signedData.child(2)
+	if err != nil {
+		return nil, err
+	}
+
+	explicitContent, err := encapContentInfo.child(1)
+	if err != nil {
+		return nil, fmt.Errorf("missing encapsulated content")
+	}
+
+	eContent, err := explicitContent.child(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return eContent.octets(0)
+}
+
+// maxBERTag is the largest tag number parseBER accepts.
+const maxBERTag = 1<<31 - 1
+
+// maxBERDepth limits how deeply values with an indefinite length, and
+// constructed OCTET STRINGs, may be nested. Every level is a stack frame, so
+// unbounded nesting in an untrusted profile could overflow the stack.
+const maxBERDepth = 64
+
+// berElement is a single BER encoded value.
+type berElement struct {
+	class       int
+	tag         int
+	constructed bool
+
+	// content holds the contents octets. For values with an indefinite
+	// length, the end-of-contents marker is not included.
+	content []byte
+}
+
+// parseBER parses the first BER encoded value in b and returns the remaining
+// bytes. depth is the number of enclosing values with an indefinite length.
+func parseBER(b []byte, depth int) (berElement, []byte, error) {
+	if depth > maxBERDepth {
+		return berElement{}, nil, fmt.Errorf("ber: nested too deeply")
+	}
+	if len(b) < 2 {
+		return berElement{}, nil, fmt.Errorf("ber: truncated value")
+	}
+
+	e := berElement{
+		class:       int(b[0] >> 6),
+		constructed: b[0]&0x20 != 0,
+		tag:         int(b[0] & 0x1f),
+	}
+	b = b[1:]
+
+	// high tag numbers are encoded in base 128 in the following bytes
+	if e.tag == 0x1f {
+		e.tag = 0
+		for {
+			if len(b) == 0 {
+				return berElement{}, nil, fmt.Errorf("ber: truncated tag")
+			}
+			c := b[0]
+			b = b[1:]
+			if e.tag > maxBERTag>>7 {
+				return berElement{}, nil, fmt.Errorf("ber: tag too large")
+			}
+			e.tag = e.tag<<7 | int(c&0x7f)
+			if c&0x80 == 0 {
+				break
+			}
+		}
+	}
+
+	if len(b) == 0 {
+		return berElement{}, nil, fmt.Errorf("ber: truncated length")
+	}
+	length := int(b[0])
+	b = b[1:]
+
+	switch {
+	case length == 0x80:
+		// indefinite length, the value ends with two zero bytes
+		if !e.constructed {
+			return berElement{}, nil, fmt.Errorf("ber: indefinite length of primitive value")
+		}
+		rest := b
+		for {
+			if len(rest) >= 2 && rest[0] == 0 && rest[1] == 0 {
+				e.content = b[:len(b)-len(rest)]
+				return e, rest[2:], nil
+			}
+			var err error
+			if _, rest, err = parseBER(rest, depth+1); err != nil {
+				return berElement{}, nil, err
+			}
+		}
+
+	case length > 0x80:
+		n := length & 0x7f
+		if n > 8 || len(b) < n {
+			return berElement{}, nil, fmt.Errorf("ber: invalid length")
+		}
+		// the length is checked before converting it, so that it can not
+		// overflow int on 32-bit platforms
+		var l uint64
+		for _, c := range b[:n] {
+			l = l<<8 | uint64(c)
+		}
+		b = b[n:]
+		if l > uint64(len(b)) {
+			return berElement{}, nil, fmt.Errorf("ber: truncated value")
+		}
+		length = int(l)
+	}
+
+	if length > len(b) {
+		return berElement{}, nil, fmt.Errorf("ber: truncated value")
+	}
+	e.content = b[:length]
+
+	return e, b[length:], nil
+}
+
+// children parses the values inside of a constructed value.
+func (e berElement) children() ([]berElement, error) {
+	if !e.constructed {
+		return nil, fmt.Errorf("ber: not a constructed value")
+	}
+
+	var children []berElement
+	for b := e.content; len(b) > 0; {
+		child, rest, err := parseBER(b, 0)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+		b = rest
+	}
+
+	return children, nil
+}
+
+// child returns the i-th value inside of a constructed value.
+func (e berElement) child(i int) (berElement, error) {
+	children, err := e.children()
+	if err != nil {
+		return berElement{}, err
+	}
+	if i >= len(children) {
+		return berElement{}, fmt.Errorf("ber: missing value")
+	}
+	return children[i], nil
+}
+
+// octets returns the bytes of an OCTET STRING, which BER allows to be split
+// into several nested OCTET STRINGs. depth is the number of enclosing
+// constructed OCTET STRINGs.
+func (e berElement) octets(depth int) ([]byte, error) {
+	if !e.constructed {
+		return e.content, nil
+	}
+	if depth >= maxBERDepth {
+		return nil, fmt.Errorf("ber: nested too deeply")
+	}
+
+	children, err := e.children()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	for _, child := range children {
+		b, err := child.octets(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+
+	return buf.Bytes(), nil
+}
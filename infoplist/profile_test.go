@@ -0,0 +1,345 @@
+package infoplist
+
+import (
+	"bytes"
+	"testing"
+)
+
+// der encodes a value with a definite length, using the long form for
+// contents of 128 bytes or more.
+func der(tag byte, contents ...[]byte) []byte {
+	content := bytes.Join(contents, nil)
+
+	b := []byte{tag}
+	switch n := len(content); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+
+	return append(b, content...)
+}
+
+// indefinite encodes a constructed value with an indefinite length.
+func indefinite(tag byte, contents ...[]byte) []byte {
+	b := []byte{tag, 0x80}
+	b = append(b, bytes.Join(contents, nil)...)
+	return append(b, 0, 0)
+}
+
+// nestedIndefinite returns n SEQUENCEs with an indefinite length nested in
+// each other.
+func nestedIndefinite(n int) []byte {
+	b := make([]byte, 0, 4*n)
+	for i := 0; i < n; i++ {
+		b = append(b, 0x30, 0x80)
+	}
+	for i := 0; i < n; i++ {
+		b = append(b, 0, 0)
+	}
+	return b
+}
+
+func TestParseBER(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		in          []byte
+		class       int
+		tag         int
+		constructed bool
+		content     []byte
+		rest        []byte
+		err         string
+	}{
+		{
+			name:    "short form",
+			in:      []byte{0x04, 0x03, 'a', 'b', 'c', 0x05, 0x00},
+			tag:     4,
+			content: []byte("abc"),
+			rest:    []byte{0x05, 0x00},
+		},
+		{
+			name:    "long form",
+			in:      []byte{0x04, 0x81, 0x03, 'a', 'b', 'c'},
+			tag:     4,
+			content: []byte("abc"),
+		},
+		{
+			name:    "long form with leading zeros",
+			in:      []byte{0x04, 0x84, 0x00, 0x00, 0x00, 0x03, 'a', 'b', 'c'},
+			tag:     4,
+			content: []byte("abc"),
+		},
+		{
+			name:        "high tag number",
+			in:          []byte{0xbf, 0x81, 0x01, 0x01, 0xff},
+			class:       2,
+			tag:         129,
+			constructed: true,
+			content:     []byte{0xff},
+		},
+		{
+			name:        "indefinite length",
+			in:          []byte{0x30, 0x80, 0x04, 0x01, 'a', 0x00, 0x00, 0xff},
+			tag:         16,
+			constructed: true,
+			content:     []byte{0x04, 0x01, 'a'},
+			rest:        []byte{0xff},
+		},
+		{
+			name:        "nested indefinite length",
+			in:          indefinite(0x30, indefinite(0x30, []byte{0x04, 0x01, 'a'})),
+			tag:         16,
+			constructed: true,
+			content:     indefinite(0x30, []byte{0x04, 0x01, 'a'}),
+		},
+		{
+			name:        "empty indefinite length",
+			in:          []byte{0x30, 0x80, 0x00, 0x00},
+			tag:         16,
+			constructed: true,
+			content:     []byte{},
+		},
+		{
+			name: "empty",
+			in:   []byte{},
+			err:  "ber: truncated value",
+		},
+		{
+			name: "missing length",
+			in:   []byte{0x04},
+			err:  "ber: truncated value",
+		},
+		{
+			name: "truncated contents",
+			in:   []byte{0x04, 0x05, 'a', 'b'},
+			err:  "ber: truncated value",
+		},
+		{
+			name: "truncated tag",
+			in:   []byte{0x1f, 0x81},
+			err:  "ber: truncated tag",
+		},
+		{
+			name: "truncated long form length",
+			in:   []byte{0x04, 0x82, 0x01},
+			err:  "ber: invalid length",
+		},
+		{
+			name: "truncated indefinite length",
+			in:   []byte{0x30, 0x80, 0x04, 0x01, 'a'},
+			err:  "ber: truncated value",
+		},
+		{
+			name: "truncated value in indefinite length",
+			in:   []byte{0x30, 0x80, 0x04, 0x05, 'a', 0x00, 0x00},
+			err:  "ber: truncated value",
+		},
+		{
+			name: "indefinite length of primitive value",
+			in:   []byte{0x04, 0x80, 'a', 0x00, 0x00},
+			err:  "ber: indefinite length of primitive value",
+		},
+		{
+			name: "long form length overflowing int32",
+			in:   []byte{0x04, 0x84, 0xff, 0xff, 0xff, 0xff, 'a'},
+			err:  "ber: truncated value",
+		},
+		{
+			name: "long form length overflowing int64",
+			in:   []byte{0x04, 0x88, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 'a'},
+			err:  "ber: truncated value",
+		},
+		{
+			name: "long form length of more than eight bytes",
+			in:   []byte{0x04, 0x89, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 'a'},
+			err:  "ber: invalid length",
+		},
+		{
+			name:        "nested at the depth limit",
+			in:          nestedIndefinite(maxBERDepth + 1),
+			tag:         16,
+			constructed: true,
+			content:     nestedIndefinite(maxBERDepth + 1)[2 : 2+4*maxBERDepth],
+		},
+		{
+			name: "nested too deeply",
+			in:   nestedIndefinite(maxBERDepth + 2),
+			err:  "ber: nested too deeply",
+		},
+		{
+			// a crafted profile of a few MB must not overflow the stack
+			name: "deeply nested",
+			in:   nestedIndefinite(1 << 20),
+			err:  "ber: nested too deeply",
+		},
+		{
+			name: "tag too large",
+			in:   []byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 0x00},
+			err:  "ber: tag too large",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e, rest, err := parseBER(tc.in, 0)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("err = %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if e.class != tc.class || e.tag != tc.tag || e.constructed != tc.constructed {
+				t.Errorf("class, tag, constructed = %d, %d, %v, want %d, %d, %v", e.class, e.tag, e.constructed, tc.class, tc.tag, tc.constructed)
+			}
+			if !bytes.Equal(e.content, tc.content) {
+				t.Errorf("content = %x, want %x", e.content, tc.content)
+			}
+			if !bytes.Equal(rest, tc.rest) {
+				t.Errorf("rest = %x, want %x", rest, tc.rest)
+			}
+		})
+	}
+}
+
+const testProfile = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Name</key>
+	<string>Test Profile</string>
+	<key>TeamIdentifier</key>
+	<array>
+		<string>ABCDE12345</string>
+	</array>
+	<key>ProvisionedDevices</key>
+	<array>
+		<string>00008030-001A2B3C4D5E6F70</string>
+	</array>
+	<key>Entitlements</key>
+	<dict>
+		<key>application-identifier</key>
+		<string>ABCDE12345.com.example.app</string>
+	</dict>
+</dict>
+</plist>
+`
+
+// signedData wraps content in a CMS SignedData structure, encoded with
+// indefinite lengths and the content split into several OCTET STRINGs like
+// the profiles Apple issues.
+func signedData(content []byte, indefiniteLengths bool) []byte {
+	oidData := []byte{0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x07, 0x01}
+
+	constructed := der
+	eContent := der(0x04, content)
+	if indefiniteLengths {
+		constructed = indefinite
+		half := len(content) / 2
+		eContent = indefinite(0x24, der(0x04, content[:half]), der(0x04, content[half:]))
+	}
+
+	return constructed(0x30,
+		der(0x06, oidSignedData),
+		constructed(0xa0,
+			constructed(0x30,
+				der(0x02, []byte{1}),
+				der(0x31),
+				constructed(0x30,
+					der(0x06, oidData),
+					constructed(0xa0, eContent),
+				),
+				der(0x31),
+			),
+		),
+	)
+}
+
+func TestParseProvisioningProfile(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		indefiniteLengths bool
+	}{
+		{"definite lengths", false},
+		{"indefinite lengths", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := signedData([]byte(testProfile), tc.indefiniteLengths)
+
+			profile, err := ParseProvisioningProfile(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if profile.Name != "Test Profile" || profile.TeamID() != "ABCDE12345" || profile.AppID() != "ABCDE12345.com.example.app" {
+				t.Errorf("profile = %+v", profile)
+			}
+			if !profile.IsProvisioned("00008030-001a2b3c4d5e6f70") {
+				t.Error("device is not provisioned")
+			}
+
+			// every truncation has to fail rather than panic
+			for i := 0; i < len(data); i++ {
+				if _, err := signedDataContent(data[:i]); err == nil {
+					t.Errorf("truncated to %d bytes: expected an error", i)
+				}
+			}
+		})
+	}
+}
+
+func TestOctetsDepth(t *testing.T) {
+	// constructed OCTET STRINGs nested in each other with definite lengths
+	nested := func(n int) berElement {
+		b := der(0x04, []byte("abc"))
+		for i := 0; i < n; i++ {
+			b = der(0x24, b)
+		}
+		e, _, err := parseBER(b, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	b, err := nested(maxBERDepth).octets(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "abc" {
+		t.Errorf("octets = %q, want %q", b, "abc")
+	}
+
+	if _, err := nested(maxBERDepth + 1).octets(0); err == nil || err.Error() != "ber: nested too deeply" {
+		t.Errorf("err = %v, want nested too deeply", err)
+	}
+}
+
+func TestSignedDataContentErrors(t *testing.T) {
+	oidData := []byte{0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x07, 0x01}
+
+	for _, tc := range []struct {
+		name string
+		in   []byte
+	}{
+		{"not a sequence", der(0x04, []byte("abc"))},
+		{"not signed data", der(0x30, der(0x06, oidData), der(0xa0, der(0x30)))},
+		{
+			"detached content",
+			der(0x30,
+				der(0x06, oidSignedData),
+				der(0xa0, der(0x30, der(0x02, []byte{1}), der(0x31), der(0x30, der(0x06, oidData)))),
+			),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := signedDataContent(tc.in); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
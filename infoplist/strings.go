@@ -0,0 +1,169 @@
+package infoplist
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"howett.net/plist"
+)
+
+// legacyLocalizations maps languages to the English names older projects
+// use for their .lproj directories.
+var legacyLocalizations = map[string]string{
+	"en": "English",
+	"fr": "French",
+	"de": "German",
+	"ja": "Japanese",
+	"es": "Spanish",
+	"it": "Italian",
+	"nl": "Dutch",
+}
+
+// ParseStrings decodes a .strings file. Both the binary plist format Xcode
+// compiles strings files to and the old-style text format, which is usually
+// UTF-16 encoded, are supported.
+func ParseStrings(data []byte) (map[string]string, error) {
+	values := make(map[string]interface{}, 0)
+	if _, err := plist.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+
+	strs := make(map[string]string, len(values))
+	for k, v := range values {
+		if s, ok := v.(string); ok {
+			strs[k] = s
+		}
+	}
+
+	return strs, nil
+}
+
+// DisplayName returns the CFBundleDisplayName of the application, falling
+// back to CFBundleName.
+func (i Info) DisplayName() string {
+	if name, _ := i[PlistKeyBundleDisplayName].(string); name != "" {
+		return name
+	}
+	name, _ := i[PlistKeyBundleName].(string)
+	return name
+}
+
+// Localizations returns the names of the .lproj directories of the
+// application, e.g. "en", "fr" or "pt-BR".
+func (p *Package) Localizations() ([]string, error) {
+	matches, err := fs.Glob(p.fsys, path.Join(p.appDir, "*.lproj"))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(matches))
+	for _, m := range matches {
+		names = append(names, strings.TrimSuffix(path.Base(m), ".lproj"))
+	}
+
+	return names, nil
+}
+
+// LocalizedInfo returns the Info.plist of the specified IPA file or unpacked
+// .app directory with the values of the InfoPlist.strings for locale applied.
+func LocalizedInfo(filename, locale string) (Info, error) {
+	pkg, err := Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer pkg.Close()
+
+	return pkg.LocalizedInfo(locale)
+}
+
+// LocalizedInfo returns the Info.plist of the application with the values of
+// the InfoPlist.strings for locale, e.g. "fr-CA", applied.
+//
+// The localization is chosen by trying the exact locale, its language, the
+// CFBundleDevelopmentRegion of the application, Base and finally English. The
+// unmodified Info.plist is returned when none of them has an
+// InfoPlist.strings.
+func (p *Package) LocalizedInfo(locale string) (Info, error) {
+	info, err := p.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	localizations, err := p.Localizations()
+	if err != nil {
+		return nil, err
+	}
+
+	developmentRegion, _ := info[PlistKeyDevelopmentRegion].(string)
+
+	for _, candidate := range localeCandidates(locale, developmentRegion) {
+		for _, l := range localizations {
+			if !strings.EqualFold(l, candidate) {
+				continue
+			}
+
+			data, err := p.ReadFile(path.Join(l+".lproj", "InfoPlist.strings"))
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				return nil, err
+			}
+
+			strs, err := ParseStrings(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s.lproj/InfoPlist.strings: %v", l, err)
+			}
+
+			localized := make(Info, len(info))
+			for k, v := range info {
+				localized[k] = v
+			}
+			for k, v := range strs {
+				localized[k] = v
+			}
+
+			return localized, nil
+		}
+	}
+
+	return info, nil
+}
+
+// localeCandidates returns the .lproj names to look for, most specific
+// first. Both "pt-BR" and "pt_BR" spellings are used in the wild, so the
+// one given is tried before the other.
+func localeCandidates(locale, developmentRegion string) []string {
+	candidates := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(names ...string) {
+		for _, name := range names {
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			candidates = append(candidates, name)
+			if legacy, ok := legacyLocalizations[name]; ok && !seen[legacy] {
+				seen[legacy] = true
+				candidates = append(candidates, legacy)
+			}
+		}
+	}
+
+	if locale != "" {
+		add(locale, strings.ReplaceAll(locale, "_", "-"), strings.ReplaceAll(locale, "-", "_"))
+
+		// drop the region, keeping the script of e.g. "zh-Hans-CN"
+		parts := strings.FieldsFunc(locale, func(r rune) bool { return r == '-' || r == '_' })
+		for i := len(parts) - 1; i > 0; i-- {
+			add(strings.Join(parts[:i], "-"))
+		}
+	}
+
+	add(developmentRegion, "Base", "en")
+
+	return candidates
+}
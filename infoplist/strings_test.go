@@ -0,0 +1,192 @@
+package infoplist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+
+	"howett.net/plist"
+)
+
+// utf16Strings encodes an old-style .strings file as UTF-16 with a BOM, the
+// way Xcode writes them.
+func utf16Strings(s string, order binary.ByteOrder) []byte {
+	units := append([]uint16{0xfeff}, utf16.Encode([]rune(s))...)
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		order.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+func TestParseStrings(t *testing.T) {
+	const oldStyle = `/* Bundle display name */
+"CFBundleDisplayName" = "Café";
+"NSCameraUsageDescription" = "Scan \"codes\"";
+`
+	want := map[string]string{
+		"CFBundleDisplayName":      "Café",
+		"NSCameraUsageDescription": `Scan "codes"`,
+	}
+
+	binaryPlist, err := plist.Marshal(map[string]interface{}{
+		"CFBundleDisplayName":          "Café",
+		"NSCameraUsageDescription":     `Scan "codes"`,
+		"UIRequiredDeviceCapabilities": []string{"arm64"},
+	}, plist.BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		want map[string]string
+		err  bool
+	}{
+		{name: "old-style UTF-8", in: []byte(oldStyle), want: want},
+		{name: "old-style UTF-16LE with BOM", in: utf16Strings(oldStyle, binary.LittleEndian), want: want},
+		{name: "old-style UTF-16BE with BOM", in: utf16Strings(oldStyle, binary.BigEndian), want: want},
+		{name: "binary plist", in: binaryPlist, want: want},
+		{name: "XML plist", in: mustPlist(t, map[string]interface{}{"CFBundleDisplayName": "Café"}), want: map[string]string{"CFBundleDisplayName": "Café"}},
+		{name: "empty", in: []byte{}, want: map[string]string{}},
+		{name: "unterminated string", in: []byte(`"CFBundleDisplayName" = "Café`), err: true},
+		{name: "missing semicolon", in: []byte(`"a" = "b" "c" = "d";`), err: true},
+		{name: "not a dictionary", in: mustPlist(t, []string{"a"}), err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			strs, err := ParseStrings(tc.in)
+			if tc.err {
+				if err == nil {
+					t.Errorf("strings = %v, expected an error", strs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(strs, tc.want) {
+				t.Errorf("strings = %q, want %q", strs, tc.want)
+			}
+		})
+	}
+}
+
+func TestLocaleCandidates(t *testing.T) {
+	for _, tc := range []struct {
+		locale            string
+		developmentRegion string
+		want              []string
+	}{
+		{"pt_BR", "de", []string{"pt_BR", "pt-BR", "pt", "de", "German", "Base", "en", "English"}},
+		{"pt-BR", "", []string{"pt-BR", "pt_BR", "pt", "Base", "en", "English"}},
+		{"zh-Hans-CN", "en", []string{"zh-Hans-CN", "zh_Hans_CN", "zh-Hans", "zh", "en", "English", "Base"}},
+		{"fr", "fr", []string{"fr", "French", "Base", "en", "English"}},
+		{"", "ja", []string{"ja", "Japanese", "Base", "en", "English"}},
+	} {
+		if got := localeCandidates(tc.locale, tc.developmentRegion); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("localeCandidates(%q, %q) = %q, want %q", tc.locale, tc.developmentRegion, got, tc.want)
+		}
+	}
+}
+
+func TestLocalizedInfo(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Test.app")
+
+	files := map[string][]byte{
+		"Info.plist": mustPlist(t, map[string]interface{}{
+			"CFBundleExecutable":        "Test",
+			"CFBundleName":              "Test",
+			"CFBundleDevelopmentRegion": "de",
+		}),
+		"pt-BR.lproj/InfoPlist.strings":  utf16Strings(`"CFBundleDisplayName" = "Teste (Brasil)";`, binary.LittleEndian),
+		"pt.lproj/InfoPlist.strings":     []byte(`"CFBundleDisplayName" = "Teste";`),
+		"German.lproj/InfoPlist.strings": []byte(`"CFBundleDisplayName" = "Prüfung";`),
+		"Base.lproj/InfoPlist.strings":   []byte(`"CFBundleDisplayName" = "Base";`),
+		"Base.lproj/Main.storyboardc":    []byte("storyboard"),
+		"fr.lproj/Main.strings":          []byte(`"title" = "Titre";`),
+		"es.lproj/InfoPlist.strings":     []byte(`"CFBundleDisplayName" = "Prueba`),
+	}
+	for name, data := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		locale string
+		want   string
+	}{
+		{"pt_BR", "Teste (Brasil)"},
+		{"pt-br", "Teste (Brasil)"},
+		{"pt-PT", "Teste"},
+		// the development region is tried before Base
+		{"ja", "Prüfung"},
+		// a localization without an InfoPlist.strings is skipped
+		{"fr", "Prüfung"},
+		{"", "Prüfung"},
+	} {
+		info, err := LocalizedInfo(dir, tc.locale)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.locale, err)
+		}
+		if name := info.DisplayName(); name != tc.want {
+			t.Errorf("%s: display name = %q, want %q", tc.locale, name, tc.want)
+		}
+		if info[PlistKeyBundleName] != "Test" {
+			t.Errorf("%s: CFBundleName = %v", tc.locale, info[PlistKeyBundleName])
+		}
+	}
+
+	if _, err := LocalizedInfo(dir, "es"); err == nil {
+		t.Error("malformed InfoPlist.strings: expected an error")
+	}
+
+	// Base is used when the development region has no InfoPlist.strings
+	if err := os.RemoveAll(filepath.Join(dir, "German.lproj")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := LocalizedInfo(dir, "ja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := info.DisplayName(); name != "Base" {
+		t.Errorf("display name = %q, want %q", name, "Base")
+	}
+}
+
+func TestLocalizedInfoPackage(t *testing.T) {
+	const app = "Payload/Test.app/"
+
+	data := zipIPA(t, map[string]testEntry{
+		app + "Info.plist":                    {data: mustPlist(t, map[string]interface{}{"CFBundleExecutable": "Test", "CFBundleName": "Test"})},
+		app + "pt_BR.lproj/InfoPlist.strings": {data: utf16Strings(`"CFBundleName" = "Teste";`, binary.BigEndian)},
+	})
+
+	pkg, err := NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for locale, want := range map[string]string{
+		"pt-BR": "Teste",
+		"pt_BR": "Teste",
+		"en":    "Test",
+	} {
+		info, err := pkg.LocalizedInfo(locale)
+		if err != nil {
+			t.Fatalf("%s: %v", locale, err)
+		}
+		if name := info.DisplayName(); name != want {
+			t.Errorf("%s: display name = %q, want %q", locale, name, want)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package infoplist
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"howett.net/plist"
+)
+
+// topLevelEntries are the entries allowed next to Payload in an IPA.
+var topLevelEntries = map[string]bool{
+	"Payload":                             true,
+	"iTunesMetadata.plist":                true,
+	"iTunesArtwork":                       true,
+	"META-INF":                            true,
+	"SwiftSupport":                        true,
+	"Symbols":                             true,
+	"BCSymbolMaps":                        true,
+	"WatchKitSupport":                     true,
+	"WatchKitSupport2":                    true,
+	"MessagesApplicationExtensionSupport": true,
+}
+
+// VerificationError lists the problems found by Verify.
+type VerificationError struct {
+	Problems []string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("ipa verification failed: %s", strings.Join(e.Problems, "; "))
+}
+
+// codeResources is the _CodeSignature/CodeResources file of a bundle.
+type codeResources struct {
+	Files  map[string]interface{} `plist:"files"`
+	Files2 map[string]interface{} `plist:"files2"`
+	Rules  map[string]interface{} `plist:"rules"`
+	Rules2 map[string]interface{} `plist:"rules2"`
+}
+
+// Verify checks the structure of the specified IPA file and the integrity
+// of the application inside of it. It returns a *VerificationError listing
+// every problem found.
+//
+// The IPA must contain exactly one Payload/*.app and no unexpected top-level
+// entries. Every file of the application, and of the frameworks, plugins and
+// watch apps nested in it, must match the hashes in the bundle's
+// _CodeSignature/CodeResources. Signatures themselves are not validated,
+// neither are the Info.plist and executable, which are sealed by the code
+// directory of the executable rather than CodeResources.
+func Verify(filename string) error {
+	zf, err := zip.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	defer zf.Close()
+
+	return verifyZip(&zf.Reader)
+}
+
+// VerifyReaderAt works like Verify, but reads the IPA from r, which is size
+// bytes long.
+func VerifyReaderAt(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	return verifyZip(zr)
+}
+
+func verifyZip(zr *zip.Reader) error {
+	v := &verifier{
+		files: make(map[string]*zip.File, len(zr.File)),
+	}
+
+	apps := make(map[string]bool)
+	for _, file := range zr.File {
+		name := strings.TrimSuffix(file.Name, "/")
+
+		if !fs.ValidPath(name) || strings.Contains(name, `\`) {
+			v.problemf("%s: invalid path", file.Name)
+			continue
+		}
+
+		parts := strings.Split(name, "/")
+		if !topLevelEntries[parts[0]] {
+			v.problemf("%s: unexpected entry", file.Name)
+		}
+
+		if parts[0] == "Payload" && len(parts) > 1 {
+			if path.Ext(parts[1]) != ".app" {
+				v.problemf("%s: unexpected entry in Payload", file.Name)
+				continue
+			}
+			apps[path.Join(parts[0], parts[1])] = true
+		}
+
+		if !file.Mode().IsDir() && !strings.HasSuffix(file.Name, "/") {
+			v.files[name] = file
+		}
+	}
+
+	switch len(apps) {
+	case 0:
+		v.problemf("missing Payload/*.app")
+	case 1:
+		for app := range apps {
+			v.verifyBundle(app)
+		}
+	default:
+		names := make([]string, 0, len(apps))
+		for app := range apps {
+			names = append(names, app)
+		}
+		sort.Strings(names)
+		v.problemf("expected exactly one application, found %s", strings.Join(names, ", "))
+	}
+
+	if len(v.problems) > 0 {
+		sort.Strings(v.problems)
+		return &VerificationError{v.problems}
+	}
+
+	return nil
+}
+
+type verifier struct {
+	// files holds the regular files and symlinks of the IPA keyed by their
+	// path.
+	files map[string]*zip.File
+
+	problems []string
+}
+
+func (v *verifier) problemf(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+// verifyBundle checks the files of the bundle at dir against its
+// CodeResources and descends into the nested bundles sealed in it.
+func (v *verifier) verifyBundle(dir string) {
+	infoPath := path.Join(dir, "Info.plist")
+	if _, ok := v.files[infoPath]; !ok {
+		v.problemf("%s: missing Info.plist", dir)
+		return
+	}
+
+	info := make(Info, 0)
+	if data, err := v.read(infoPath); err != nil {
+		v.problemf("%s: %v", infoPath, err)
+	} else if _, err := plist.Unmarshal(data, &info); err != nil {
+		v.problemf("%s: %v", infoPath, err)
+	}
+
+	executable, _ := info[PlistKeyBundleExecutable].(string)
+	if executable != "" {
+		if _, ok := v.files[path.Join(dir, executable)]; !ok {
+			v.problemf("%s: missing executable %s", dir, executable)
+		}
+	}
+
+	resourcesPath := path.Join(dir, "_CodeSignature", "CodeResources")
+	data, err := v.read(resourcesPath)
+	if err != nil {
+		v.problemf("%s: missing _CodeSignature/CodeResources", dir)
+		return
+	}
+
+	resources := codeResources{}
+	if _, err := plist.Unmarshal(data, &resources); err != nil {
+		v.problemf("%s: %v", resourcesPath, err)
+		return
+	}
+
+	sealed, rules := resources.Files2, resources.Rules2
+	if sealed == nil {
+		sealed, rules = resources.Files, resources.Rules
+	}
+
+	nested := make([]string, 0)
+	for name, seal := range sealed {
+		filePath := path.Join(dir, name)
+
+		switch s := seal.(type) {
+		case []byte:
+			v.verifyHash(filePath, sha1.New(), s)
+
+		case map[string]interface{}:
+			if _, ok := s["cdhash"]; ok {
+				nested = append(nested, name)
+				if v.isDir(filePath) {
+					v.verifyBundle(filePath)
+				} else if _, ok := v.files[filePath]; !ok {
+					v.problemf("%s: missing nested code", filePath)
+				}
+				continue
+			}
+
+			if target, ok := s["symlink"].(string); ok {
+				v.verifySymlink(filePath, target)
+				continue
+			}
+
+			if optional, _ := s["optional"].(bool); optional {
+				if _, ok := v.files[filePath]; !ok {
+					continue
+				}
+			}
+
+			if digest, ok := s["hash2"].([]byte); ok {
+				v.verifyHash(filePath, sha256.New(), digest)
+			} else if digest, ok := s["hash"].([]byte); ok {
+				v.verifyHash(filePath, sha1.New(), digest)
+			} else {
+				v.problemf("%s: unsupported seal", filePath)
+			}
+		}
+	}
+
+	omitted := omitRules(rules)
+
+	// every file that is not omitted by the rules must be sealed
+	for filePath := range v.files {
+		if !strings.HasPrefix(filePath, dir+"/") {
+			continue
+		}
+		name := strings.TrimPrefix(filePath, dir+"/")
+
+		if name == executable || strings.HasPrefix(name, "_CodeSignature/") {
+			continue
+		}
+		if _, ok := sealed[name]; ok {
+			continue
+		}
+		if isNested(name, nested) || matchesAny(name, omitted) {
+			continue
+		}
+
+		v.problemf("%s: file is not sealed", filePath)
+	}
+}
+
+func (v *verifier) verifyHash(filePath string, h hash.Hash, expected []byte) {
+	file, ok := v.files[filePath]
+	if !ok {
+		v.problemf("%s: missing file", filePath)
+		return
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		v.problemf("%s: %v", filePath, err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		v.problemf("%s: %v", filePath, err)
+		return
+	}
+
+	if !bytes.Equal(h.Sum(nil), expected) {
+		v.problemf("%s: hash mismatch", filePath)
+	}
+}
+
+func (v *verifier) verifySymlink(filePath, target string) {
+	file, ok := v.files[filePath]
+	if !ok {
+		v.problemf("%s: missing symlink", filePath)
+		return
+	}
+
+	if file.Mode()&fs.ModeSymlink == 0 {
+		v.problemf("%s: not a symlink", filePath)
+		return
+	}
+
+	data, err := v.read(filePath)
+	if err != nil {
+		v.problemf("%s: %v", filePath, err)
+		return
+	}
+
+	if string(data) != target {
+		v.problemf("%s: symlink points to %s instead of %s", filePath, data, target)
+	}
+}
+
+func (v *verifier) read(filePath string) ([]byte, error) {
+	file, ok := v.files[filePath]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+func (v *verifier) isDir(dir string) bool {
+	for filePath := range v.files {
+		if strings.HasPrefix(filePath, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// omitRules returns the rules which exclude files from the seal.
+func omitRules(rules map[string]interface{}) []*regexp.Regexp {
+	omitted := make([]*regexp.Regexp, 0)
+	for pattern, rule := range rules {
+		r, ok := rule.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if omit, _ := r["omit"].(bool); !omit {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			continue
+		}
+		omitted = append(omitted, re)
+	}
+	return omitted
+}
+
+func matchesAny(name string, patterns []*regexp.Regexp) bool {
+	for _, re := range patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNested reports whether name is inside one of the nested bundles.
+func isNested(name string, nested []string) bool {
+	for _, n := range nested {
+		if strings.HasPrefix(name, n+"/") {
+			return true
+		}
+	}
+	return false
+}
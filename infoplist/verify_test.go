@@ -0,0 +1,323 @@
+package infoplist
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+
+	"howett.net/plist"
+)
+
+// testEntry is a file of a test IPA.
+type testEntry struct {
+	data    []byte
+	symlink bool
+}
+
+func sha1Sum(b []byte) []byte {
+	h := sha1.Sum(b)
+	return h[:]
+}
+
+func sha256Sum(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+func mustPlist(t *testing.T, v interface{}) []byte {
+	t.Helper()
+
+	b, err := plist.Marshal(v, plist.XMLFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testIPA returns the entries of an IPA with an application that has
+// resources sealed by hash, an optional resource, a symlink, an omitted
+// file and a nested framework.
+func testIPA(t *testing.T) map[string]testEntry {
+	t.Helper()
+
+	const app = "Payload/Test.app/"
+	const framework = app + "Frameworks/Nested.framework/"
+
+	frameworkResource := []byte("framework resource")
+	frameworkResources := mustPlist(t, map[string]interface{}{
+		"files2": map[string]interface{}{
+			"Resource.txt": map[string]interface{}{"hash2": sha256Sum(frameworkResource)},
+		},
+		"rules2": map[string]interface{}{
+			"^.*":            true,
+			"^Info\\.plist$": map[string]interface{}{"omit": true, "weight": 20.0},
+		},
+	})
+
+	strings := []byte(`"title" = "Test";`)
+	optional := []byte("optional")
+
+	resources := mustPlist(t, map[string]interface{}{
+		"files2": map[string]interface{}{
+			"Base.lproj/Main.strings": map[string]interface{}{"hash2": sha256Sum(strings)},
+			"Optional.txt":            map[string]interface{}{"hash2": sha256Sum(optional), "optional": true},
+			"Link.strings":            map[string]interface{}{"symlink": "Base.lproj/Main.strings"},
+			"Frameworks/Nested.framework": map[string]interface{}{
+				"cdhash":      sha1Sum([]byte("nested")),
+				"requirement": "identifier \"com.example.nested\"",
+			},
+		},
+		"rules2": map[string]interface{}{
+			"^.*":                 true,
+			"^(.*/)?\\.DS_Store$": map[string]interface{}{"omit": true, "weight": 2000.0},
+			"^Info\\.plist$":      map[string]interface{}{"omit": true, "weight": 20.0},
+		},
+	})
+
+	return map[string]testEntry{
+		app + "Info.plist":                         {data: mustPlist(t, map[string]interface{}{"CFBundleExecutable": "Test"})},
+		app + "Test":                               {data: []byte("executable")},
+		app + "_CodeSignature/CodeResources":       {data: resources},
+		app + "Base.lproj/Main.strings":            {data: strings},
+		app + "Optional.txt":                       {data: optional},
+		app + "Link.strings":                       {data: []byte("Base.lproj/Main.strings"), symlink: true},
+		app + ".DS_Store":                          {data: []byte("omitted")},
+		framework + "Info.plist":                   {data: mustPlist(t, map[string]interface{}{"CFBundleExecutable": "Nested"})},
+		framework + "Nested":                       {data: []byte("nested executable")},
+		framework + "_CodeSignature/CodeResources": {data: frameworkResources},
+		framework + "Resource.txt":                 {data: frameworkResource},
+	}
+}
+
+func zipIPA(t *testing.T, entries map[string]testEntry) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for name, e := range entries {
+		fh := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		fh.SetMode(0644)
+		if e.symlink {
+			fh.SetMode(fs.ModeSymlink | 0755)
+		}
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestVerify(t *testing.T) {
+	const app = "Payload/Test.app/"
+	const framework = app + "Frameworks/Nested.framework/"
+
+	for _, tc := range []struct {
+		name     string
+		modify   func(map[string]testEntry)
+		problems []string
+	}{
+		{
+			name:   "valid",
+			modify: func(map[string]testEntry) {},
+		},
+		{
+			name: "tampered file",
+			modify: func(e map[string]testEntry) {
+				e[app+"Base.lproj/Main.strings"] = testEntry{data: []byte(`"title" = "Tampered";`)}
+			},
+			problems: []string{app + "Base.lproj/Main.strings: hash mismatch"},
+		},
+		{
+			name: "missing file",
+			modify: func(e map[string]testEntry) {
+				delete(e, app+"Base.lproj/Main.strings")
+			},
+			problems: []string{app + "Base.lproj/Main.strings: missing file"},
+		},
+		{
+			name: "missing optional file",
+			modify: func(e map[string]testEntry) {
+				delete(e, app+"Optional.txt")
+			},
+		},
+		{
+			name: "tampered optional file",
+			modify: func(e map[string]testEntry) {
+				e[app+"Optional.txt"] = testEntry{data: []byte("tampered")}
+			},
+			problems: []string{app + "Optional.txt: hash mismatch"},
+		},
+		{
+			name: "unsealed file",
+			modify: func(e map[string]testEntry) {
+				e[app+"Extra.txt"] = testEntry{data: []byte("extra")}
+			},
+			problems: []string{app + "Extra.txt: file is not sealed"},
+		},
+		{
+			name: "omitted file in a subdirectory",
+			modify: func(e map[string]testEntry) {
+				e[app+"Base.lproj/.DS_Store"] = testEntry{data: []byte("omitted")}
+			},
+		},
+		{
+			name: "retargeted symlink",
+			modify: func(e map[string]testEntry) {
+				e[app+"Link.strings"] = testEntry{data: []byte("Optional.txt"), symlink: true}
+			},
+			problems: []string{app + "Link.strings: symlink points to Optional.txt instead of Base.lproj/Main.strings"},
+		},
+		{
+			name: "symlink replaced by a file",
+			modify: func(e map[string]testEntry) {
+				e[app+"Link.strings"] = testEntry{data: []byte("Base.lproj/Main.strings")}
+			},
+			problems: []string{app + "Link.strings: not a symlink"},
+		},
+		{
+			name: "missing symlink",
+			modify: func(e map[string]testEntry) {
+				delete(e, app+"Link.strings")
+			},
+			problems: []string{app + "Link.strings: missing symlink"},
+		},
+		{
+			name: "tampered file in nested bundle",
+			modify: func(e map[string]testEntry) {
+				e[framework+"Resource.txt"] = testEntry{data: []byte("tampered")}
+			},
+			problems: []string{framework + "Resource.txt: hash mismatch"},
+		},
+		{
+			name: "missing file in nested bundle",
+			modify: func(e map[string]testEntry) {
+				delete(e, framework+"Resource.txt")
+			},
+			problems: []string{framework + "Resource.txt: missing file"},
+		},
+		{
+			name: "unsealed file in nested bundle",
+			modify: func(e map[string]testEntry) {
+				e[framework+"Extra.txt"] = testEntry{data: []byte("extra")}
+			},
+			problems: []string{framework + "Extra.txt: file is not sealed"},
+		},
+		{
+			name: "missing nested bundle",
+			modify: func(e map[string]testEntry) {
+				for name := range e {
+					if len(name) > len(framework) && name[:len(framework)] == framework {
+						delete(e, name)
+					}
+				}
+			},
+			problems: []string{app + "Frameworks/Nested.framework: missing nested code"},
+		},
+		{
+			name: "missing executable",
+			modify: func(e map[string]testEntry) {
+				delete(e, app+"Test")
+			},
+			problems: []string{"Payload/Test.app: missing executable Test"},
+		},
+		{
+			name: "missing CodeResources",
+			modify: func(e map[string]testEntry) {
+				delete(e, app+"_CodeSignature/CodeResources")
+			},
+			problems: []string{"Payload/Test.app: missing _CodeSignature/CodeResources"},
+		},
+		{
+			name: "unexpected top-level entry",
+			modify: func(e map[string]testEntry) {
+				e["Extra/file"] = testEntry{data: []byte("extra")}
+			},
+			problems: []string{"Extra/file: unexpected entry"},
+		},
+		{
+			name: "two applications",
+			modify: func(e map[string]testEntry) {
+				e["Payload/Other.app/Info.plist"] = testEntry{data: []byte("other")}
+			},
+			problems: []string{"expected exactly one application, found Payload/Other.app, Payload/Test.app"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entries := testIPA(t)
+			tc.modify(entries)
+			data := zipIPA(t, entries)
+
+			err := VerifyReaderAt(bytes.NewReader(data), int64(len(data)))
+			if len(tc.problems) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			var verr *VerificationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("err = %v, want a *VerificationError", err)
+			}
+			if !reflect.DeepEqual(verr.Problems, tc.problems) {
+				t.Errorf("problems = %q, want %q", verr.Problems, tc.problems)
+			}
+		})
+	}
+}
+
+func TestVerifyLegacyResources(t *testing.T) {
+	const app = "Payload/Test.app/"
+
+	info := mustPlist(t, map[string]interface{}{"CFBundleExecutable": "Test"})
+	resource := []byte("resource")
+	resources := mustPlist(t, map[string]interface{}{
+		"files": map[string]interface{}{
+			"Info.plist":   sha1Sum(info),
+			"Resource.txt": sha1Sum(resource),
+			"Optional.txt": map[string]interface{}{"hash": sha1Sum([]byte("optional")), "optional": true},
+		},
+		"rules": map[string]interface{}{
+			"^.*":             true,
+			"^Omitted/":       map[string]interface{}{"omit": true, "weight": 20.0},
+			"^version.plist$": true,
+		},
+	})
+
+	entries := map[string]testEntry{
+		app + "Info.plist":                   {data: info},
+		app + "Test":                         {data: []byte("executable")},
+		app + "_CodeSignature/CodeResources": {data: resources},
+		app + "Resource.txt":                 {data: resource},
+		app + "Omitted/file":                 {data: []byte("omitted")},
+	}
+
+	data := zipIPA(t, entries)
+	if err := VerifyReaderAt(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	entries[app+"Resource.txt"] = testEntry{data: []byte("tampered")}
+	data = zipIPA(t, entries)
+
+	var verr *VerificationError
+	if err := VerifyReaderAt(bytes.NewReader(data), int64(len(data))); !errors.As(err, &verr) {
+		t.Fatalf("err = %v, want a *VerificationError", err)
+	}
+	if want := []string{app + "Resource.txt: hash mismatch"}; !reflect.DeepEqual(verr.Problems, want) {
+		t.Errorf("problems = %q, want %q", verr.Problems, want)
+	}
+}
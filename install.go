@@ -3,16 +3,92 @@ package xcdevice
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/romantomjak/xcdevice/infoplist"
+	"github.com/romantomjak/xcdevice/machoinfo"
 )
 
-func Install(device *Device, filepath string) error {
-	if _, err := os.Stat(filepath); err != nil {
+// stagingPath is the directory, relative to the AFC root, that packages are
+// uploaded to before they are installed.
+const stagingPath = "PublicStaging"
+
+var (
+	// ErrCapabilitiesMismatch is returned by Install when the device lacks
+	// some of the UIRequiredDeviceCapabilities of the application.
+	ErrCapabilitiesMismatch = errors.New("device does not have the required capabilities")
+
+	// ErrProfileExpired is returned by Install when the embedded provisioning
+	// profile of the application has expired.
+	ErrProfileExpired = errors.New("provisioning profile has expired")
+
+	// ErrDeviceNotProvisioned is returned by Install when the device is not
+	// included in the embedded provisioning profile of the application.
+	ErrDeviceNotProvisioned = errors.New("device is not included in the provisioning profile")
+
+	// ErrExecutableEncrypted is returned by Install when the application
+	// executable is encrypted, as App Store downloads are.
+	ErrExecutableEncrypted = errors.New("application executable is encrypted")
+
+	// ErrArchitectureNotSupported is returned by Install when the application
+	// executable has no slice the device can run.
+	ErrArchitectureNotSupported = errors.New("application executable does not support the device architecture")
+)
+
+// Install uploads the IPA or unpacked .app directory at filepath to the
+// device and installs it. Status updates from the installation proxy are
+// reported to progress, preceded by an "UploadingPackage" update while the
+// package is being copied to the device.
+//
+// opts may be nil. CFBundleIdentifier defaults to the bundle ID read from the
+// IPA's Info.plist. The uploaded package is removed from the device once the
+// installation finishes, whether it succeeded or not, unless
+// KeepStagedPackage is set.
+func Install(device *Device, filepath string, opts *InstallOptions, progress ProgressFunc) error {
+	return installFile(device, filepath, opts, progress, false)
+}
+
+// Upgrade works like Install, but replaces an already installed version of
+// the application while keeping its data.
+func Upgrade(device *Device, filepath string, opts *InstallOptions, progress ProgressFunc) error {
+	return installFile(device, filepath, opts, progress, true)
+}
+
+// InstallFrom works like Install, but reads the IPA from r, which is size
+// bytes long. The IPA is streamed to the device rather than read into memory,
+// so r can be an infoplist.HTTPReaderAt to install straight from remote
+// storage.
+func InstallFrom(device *Device, r io.ReaderAt, size int64, opts *InstallOptions, progress ProgressFunc) error {
+	return installReaderAt(device, r, size, opts, progress, false)
+}
+
+// UpgradeFrom works like Upgrade, but reads the IPA from r, see InstallFrom.
+func UpgradeFrom(device *Device, r io.ReaderAt, size int64, opts *InstallOptions, progress ProgressFunc) error {
+	return installReaderAt(device, r, size, opts, progress, true)
+}
+
+// installSource is a package to be installed.
+type installSource struct {
+	pkg *infoplist.Package
+
+	// dir is the path of an unpacked .app directory. It is empty for IPAs,
+	// which are read from r instead.
+	dir  string
+	r    io.ReaderAt
+	size int64
+}
+
+func installFile(device *Device, filepath string, opts *InstallOptions, progress ProgressFunc, upgrade bool) error {
+	fi, err := os.Stat(filepath)
+	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			log.Printf("the file at %s does not exist. typo?\n", filepath)
 			return err
@@ -20,7 +96,37 @@ func Install(device *Device, filepath string) error {
 		return err
 	}
 
-	info, err := infoplist.Stat(filepath)
+	if fi.IsDir() {
+		pkg, err := infoplist.Open(filepath)
+		if err != nil {
+			return err
+		}
+		defer pkg.Close()
+
+		return install(device, &installSource{pkg: pkg, dir: filepath}, opts, progress, upgrade)
+	}
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return installReaderAt(device, f, fi.Size(), opts, progress, upgrade)
+}
+
+func installReaderAt(device *Device, r io.ReaderAt, size int64, opts *InstallOptions, progress ProgressFunc, upgrade bool) error {
+	pkg, err := infoplist.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	defer pkg.Close()
+
+	return install(device, &installSource{pkg: pkg, r: r, size: size}, opts, progress, upgrade)
+}
+
+func install(device *Device, src *installSource, opts *InstallOptions, progress ProgressFunc, upgrade bool) error {
+	info, err := src.pkg.Info()
 	if err != nil {
 		return err
 	}
@@ -30,17 +136,54 @@ func Install(device *Device, filepath string) error {
 		return fmt.Errorf("failed to cast BundleIdentifier")
 	}
 
+	profile, err := src.pkg.ProvisioningProfile()
+	if err != nil && !errors.Is(err, infoplist.ErrNoProvisioningProfile) {
+		return err
+	}
+	if profile != nil {
+		if profile.Expired() {
+			return fmt.Errorf("%w: %q expired on %s", ErrProfileExpired, profile.Name, profile.ExpirationDate.Format(time.RFC1123))
+		}
+		if !profile.IsProvisioned(device.SerialNumber) {
+			return fmt.Errorf("%w: %q does not include %s", ErrDeviceNotProvisioned, profile.Name, device.SerialNumber)
+		}
+	}
+
 	lockdown, err := LockdownService(device)
 	if err != nil {
 		return fmt.Errorf("lockdown: %v", err)
 	}
 
+	if err := checkCompatibility(lockdown, info); err != nil {
+		return err
+	}
+
+	if err := checkExecutable(lockdown, src.pkg); err != nil {
+		return err
+	}
+
+	installationProxy, err := lockdown.InstallationProxyService()
+	if err != nil {
+		return fmt.Errorf("installation proxy: %v", err)
+	}
+
+	// check that the device can run the application before spending time
+	// on uploading it
+	if capabilities := info.RequiredDeviceCapabilities(); len(capabilities) > 0 {
+		ok, err := installationProxy.CheckCapabilitiesMatch(capabilities)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrCapabilitiesMismatch, strings.Join(capabilities, ", "))
+		}
+	}
+
 	afc, err := lockdown.AFCService()
 	if err != nil {
 		return fmt.Errorf("afc: %v", err)
 	}
 
-	stagingPath := "PublicStaging"
 	pathInfo, err := afc.Stat(stagingPath)
 	if err != nil {
 		if !errors.Is(err, ErrObjectNotFound) {
@@ -53,25 +196,204 @@ func Install(device *Device, filepath string) error {
 		}
 	}
 
-	installationPath := path.Join(stagingPath, fmt.Sprintf("%s.ipa", bundleID))
+	installOptions := InstallOptions{}
+	if opts != nil {
+		installOptions = *opts
+	}
+	if installOptions.CFBundleIdentifier == "" {
+		installOptions.CFBundleIdentifier = bundleID
+	}
+
+	if progress != nil {
+		progress("UploadingPackage", 0)
+	}
+
+	var installationPath string
+	if src.dir != "" {
+		installationPath = path.Join(stagingPath, bundleID)
+	} else {
+		installationPath = path.Join(stagingPath, fmt.Sprintf("%s.ipa", bundleID))
+	}
 
-	bytes, err := os.ReadFile(filepath)
+	if !installOptions.KeepStagedPackage {
+		defer func() {
+			if err := afc.RemoveAll(installationPath); err != nil && !errors.Is(err, ErrObjectNotFound) {
+				log.Printf("failed to remove staged package %s: %v\n", installationPath, err)
+			}
+		}()
+	}
+
+	if src.dir != "" {
+		if err := uploadDirectory(afc, src.dir, installationPath); err != nil {
+			return err
+		}
+
+		if installOptions.PackageType == "" {
+			installOptions.PackageType = PackageTypeDeveloper
+		}
+	} else {
+		ipa := io.NewSectionReader(src.r, 0, src.size)
+		if err := afc.WriteFileFrom(installationPath, ipa, AfcFileModeWr); err != nil {
+			return err
+		}
+	}
+
+	if upgrade {
+		err = installationProxy.UpgradeApplication(installationPath, &installOptions, progress)
+	} else {
+		err = installationProxy.InstallApplication(installationPath, &installOptions, progress)
+	}
 	if err != nil {
 		return err
 	}
 
-	if err := afc.WriteFile(installationPath, bytes, AfcFileModeWr); err != nil {
+	return nil
+}
+
+// uploadDirectory copies the .app directory at src to dst on the device,
+// recreating symlinks rather than following them.
+//
+// AFC has no way of setting file modes, so executable bits are not copied.
+// installd restores them on the bundle executables when it installs a
+// Developer package.
+func uploadDirectory(afc *AFC, src, dst string) error {
+	// clean up leftovers from a previous upload, so that files removed from
+	// the bundle do not end up being installed
+	if err := afc.RemoveAll(dst); err != nil && !errors.Is(err, ErrObjectNotFound) {
 		return err
 	}
 
-	installationProxy, err := lockdown.InstallationProxyService()
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		remotePath := path.Join(dst, filepath.ToSlash(rel))
+
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return afc.CreateSymlink(target, remotePath)
+
+		case d.IsDir():
+			return afc.CreateDirectory(remotePath)
+
+		default:
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			return afc.WriteFileFrom(remotePath, f, AfcFileModeWr)
+		}
+	})
+}
+
+// deviceClassFamilies maps the DeviceClass reported by lockdownd to the
+// UIDeviceFamily values the device can run. iPads run iPhone apps too.
+var deviceClassFamilies = map[string][]int{
+	"iPhone":  {infoplist.DeviceFamilyiPhone},
+	"iPod":    {infoplist.DeviceFamilyiPhone},
+	"iPad":    {infoplist.DeviceFamilyiPhone, infoplist.DeviceFamilyiPad},
+	"AppleTV": {infoplist.DeviceFamilyAppleTV},
+	"Watch":   {infoplist.DeviceFamilyWatch},
+}
+
+// checkCompatibility compares the MinimumOSVersion and UIDeviceFamily of the
+// application with the ProductVersion and DeviceClass of the device.
+func checkCompatibility(lockdown *Lockdown, info infoplist.Info) error {
+	if minimumVersion := info.MinimumOSVersion(); minimumVersion != "" {
+		v, err := lockdown.GetValue("", "ProductVersion")
+		if err != nil {
+			return fmt.Errorf("lockdown: %v", err)
+		}
+		productVersion, _ := v.(string)
+
+		if productVersion != "" && compareVersions(productVersion, minimumVersion) < 0 {
+			return fmt.Errorf("%w: application requires %s, device runs %s", ErrDeviceOSVersionTooLow, minimumVersion, productVersion)
+		}
+	}
+
+	v, err := lockdown.GetValue("", "DeviceClass")
 	if err != nil {
-		return fmt.Errorf("installation proxy: %v", err)
+		return fmt.Errorf("lockdown: %v", err)
 	}
+	deviceClass, _ := v.(string)
 
-	if err := installationProxy.InstallApplication(bundleID, installationPath); err != nil {
-		return err
+	supported, ok := deviceClassFamilies[deviceClass]
+	if !ok {
+		// we don't know what this device can run, let installd decide
+		return nil
+	}
+
+	families := info.DeviceFamily()
+	for _, f := range families {
+		for _, s := range supported {
+			if f == s {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%w: application supports device families %v, device class is %s", ErrDeviceFamilyNotSupported, families, deviceClass)
+}
+
+// checkExecutable inspects the application executable, which must not be
+// encrypted and must have a slice for the CPUArchitecture of the device.
+func checkExecutable(lockdown *Lockdown, pkg *infoplist.Package) error {
+	executable, err := machoinfo.InspectPackage(pkg)
+	if err != nil {
+		return fmt.Errorf("executable: %v", err)
+	}
+
+	if executable.Encrypted() {
+		return fmt.Errorf("%w: %s", ErrExecutableEncrypted, executable.Name)
+	}
+
+	v, err := lockdown.GetValue("", "CPUArchitecture")
+	if err != nil {
+		return fmt.Errorf("lockdown: %v", err)
+	}
+	cpuArchitecture, _ := v.(string)
+
+	if !executable.RunsOn(cpuArchitecture) {
+		return fmt.Errorf("%w: %s has %s, device is %s", ErrArchitectureNotSupported,
+			executable.Name, strings.Join(executable.Architectures(), ", "), cpuArchitecture)
 	}
 
 	return nil
 }
+
+// compareVersions compares two dotted version strings like "16.4.1",
+// returning -1, 0 or 1. Missing components are treated as zero.
+func compareVersions(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+
+	return 0
+}
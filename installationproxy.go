@@ -1,14 +1,10 @@
 package xcdevice
 
 import (
-	"bytes"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net"
-
-	"howett.net/plist"
+	"strings"
 )
 
 type ApplicationType string
@@ -20,6 +16,15 @@ const (
 	ApplicationTypeInternal ApplicationType = "Internal"
 )
 
+// ArchiveType selects which parts of an application are archived.
+type ArchiveType string
+
+const (
+	ArchiveTypeAll             ArchiveType = "All"
+	ArchiveTypeApplicationOnly ArchiveType = "ApplicationOnly"
+	ArchiveTypeDocumentsOnly   ArchiveType = "DocumentsOnly"
+)
+
 var DefaultLookupAttributes = []string{
 	"CFBundleDisplayName",
 	"CFBundleExecutable",
@@ -27,11 +32,197 @@ var DefaultLookupAttributes = []string{
 	"CFBundleVersion",
 	"CFBundleShortVersionString",
 	"CFBundleIdentifier",
+	"ApplicationType",
+	"Path",
+	"Container",
+	"SignerIdentity",
+	"Entitlements",
+}
+
+// Application is an application installed on the device. Only the
+// attributes requested from the installation proxy are set.
+type Application struct {
+	BundleID        string
+	DisplayName     string
+	Name            string
+	Executable      string
+	Version         string
+	ShortVersion    string
+	Path            string
+	Container       string
+	Entitlements    map[string]interface{} `json:",omitempty"`
+	ApplicationType ApplicationType
+	SignerIdentity  string
+
+	// Extras holds the attributes that do not have a field of their own,
+	// keyed by their Info.plist name.
+	Extras map[string]interface{} `json:",omitempty"`
+}
+
+// UnmarshalPlist implements plist.Unmarshaler.
+func (a *Application) UnmarshalPlist(unmarshal func(interface{}) error) error {
+	attributes := make(map[string]interface{}, 0)
+	if err := unmarshal(&attributes); err != nil {
+		return err
+	}
+
+	*a = Application{}
+	for k, v := range attributes {
+		switch k {
+		case "CFBundleIdentifier":
+			a.BundleID, _ = v.(string)
+		case "CFBundleDisplayName":
+			a.DisplayName, _ = v.(string)
+		case "CFBundleName":
+			a.Name, _ = v.(string)
+		case "CFBundleExecutable":
+			a.Executable, _ = v.(string)
+		case "CFBundleVersion":
+			a.Version, _ = v.(string)
+		case "CFBundleShortVersionString":
+			a.ShortVersion, _ = v.(string)
+		case "Path":
+			a.Path, _ = v.(string)
+		case "Container":
+			a.Container, _ = v.(string)
+		case "Entitlements":
+			a.Entitlements, _ = v.(map[string]interface{})
+		case "ApplicationType":
+			t, _ := v.(string)
+			a.ApplicationType = ApplicationType(t)
+		case "SignerIdentity":
+			a.SignerIdentity, _ = v.(string)
+		default:
+			if a.Extras == nil {
+				a.Extras = make(map[string]interface{})
+			}
+			a.Extras[k] = v
+		}
+	}
+
+	return nil
+}
+
+var (
+	ErrAlreadyArchived               = errors.New("application is already archived")
+	ErrApplicationAlreadyInstalled   = errors.New("application is already installed")
+	ErrApplicationVerificationFailed = errors.New("application verification failed")
+	ErrBundleVerificationFailed      = errors.New("bundle verification failed")
+	ErrDeviceFamilyNotSupported      = errors.New("device family not supported")
+	ErrDeviceOSVersionTooLow         = errors.New("device os version too low")
+	ErrEmbeddedProfileInstallFailed  = errors.New("embedded profile install failed")
+	ErrIncorrectArchitecture         = errors.New("incorrect architecture")
+	ErrInstallProhibited             = errors.New("install prohibited")
+	ErrInsufficientSpace             = errors.New("insufficient space on device")
+	ErrMissingBundleExecutable       = errors.New("missing bundle executable")
+	ErrMissingBundleIdentifier       = errors.New("missing bundle identifier")
+	ErrNotEntitled                   = errors.New("not entitled")
+	ErrPackageExtractionFailed       = errors.New("package extraction failed")
+	ErrPackageInspectionFailed       = errors.New("package inspection failed")
+	ErrUninstallProhibited           = errors.New("uninstall prohibited")
+)
+
+var (
+	installErrorsToErrors = map[string]error{
+		"AlreadyArchived":               ErrAlreadyArchived,
+		"ApplicationAlreadyInstalled":   ErrApplicationAlreadyInstalled,
+		"ApplicationVerificationFailed": ErrApplicationVerificationFailed,
+		"BundleVerificationFailed":      ErrBundleVerificationFailed,
+		"DeviceFamilyNotSupported":      ErrDeviceFamilyNotSupported,
+		"DeviceOSVersionTooLow":         ErrDeviceOSVersionTooLow,
+		"EmbeddedProfileInstallFailed":  ErrEmbeddedProfileInstallFailed,
+		"IncorrectArchitecture":         ErrIncorrectArchitecture,
+		"InstallProhibited":             ErrInstallProhibited,
+		"MissingBundleExecutable":       ErrMissingBundleExecutable,
+		"MissingBundleIdentifier":       ErrMissingBundleIdentifier,
+		"NotEntitled":                   ErrNotEntitled,
+		"PackageExtractionFailed":       ErrPackageExtractionFailed,
+		"PackageInspectionFailed":       ErrPackageInspectionFailed,
+		"UninstallProhibited":           ErrUninstallProhibited,
+	}
+)
+
+// InstallError is returned when the installation proxy fails to carry out a
+// command. Name, Description and Detail hold the Error, ErrorDescription and
+// ErrorDetail values sent by the device.
+//
+// Use errors.Is with one of the sentinel errors above to check for the common
+// failures, e.g. errors.Is(err, ErrApplicationVerificationFailed) for an
+// expired or mismatched provisioning profile.
+type InstallError struct {
+	Command     string
+	Status      string
+	Name        string
+	Description string
+	Detail      int
+}
+
+func (e *InstallError) Error() string {
+	if e.Detail != 0 {
+		return fmt.Sprintf("%s: %s (err: %s, desc: %s, detail: %d)", e.Command, e.Status, e.Name, e.Description, e.Detail)
+	}
+	return fmt.Sprintf("%s: %s (err: %s, desc: %s)", e.Command, e.Status, e.Name, e.Description)
+}
+
+// Is reports whether target is the sentinel error for the error name sent
+// by the device.
+//
+// installd has no error name for a full disk, it reports whichever step ran
+// out of space with ENOSPC in the description, so ErrInsufficientSpace is
+// matched by the description instead.
+func (e *InstallError) Is(target error) bool {
+	if target == ErrInsufficientSpace {
+		return strings.Contains(e.Description, "No space left on device")
+	}
+	err, ok := installErrorsToErrors[e.Name]
+	return ok && err == target
+}
+
+// ProgressFunc is called for every status update sent by the installation
+// proxy while a command is running, e.g. "CreatingStagingDirectory" or
+// "VerifyingApplication", together with the overall percentage complete.
+type ProgressFunc func(status string, percent int)
+
+// PackageType tells installd what kind of package is being installed.
+type PackageType string
+
+const (
+	// PackageTypeCustomer is a zipped IPA. This is the default.
+	PackageTypeCustomer PackageType = "Customer"
+
+	// PackageTypeDeveloper is an unpacked .app bundle.
+	PackageTypeDeveloper PackageType = "Developer"
+)
+
+// InstallOptions are the client options understood by the Install and
+// Upgrade commands. Empty fields are not sent to the device.
+type InstallOptions struct {
+	// PackageType describes the uploaded package. installd assumes an IPA
+	// when it is not set.
+	PackageType PackageType `plist:",omitempty"`
+
+	// CFBundleIdentifier is the bundle ID of the application being
+	// installed.
+	CFBundleIdentifier string `plist:",omitempty"`
+
+	// ITunesMetadata is the contents of the iTunesMetadata.plist to store
+	// alongside the application.
+	ITunesMetadata []byte `plist:"iTunesMetadata,omitempty"`
+
+	// ITunesArtwork is the artwork image to store alongside the application.
+	ITunesArtwork []byte `plist:"iTunesArtwork,omitempty"`
+
+	// ApplicationSINF is the DRM information of an App Store application.
+	ApplicationSINF []byte `plist:",omitempty"`
+
+	// KeepStagedPackage leaves the uploaded package in PublicStaging once
+	// Install or Upgrade are done. It is never sent to the device.
+	KeepStagedPackage bool `plist:"-"`
 }
 
 type installationProxyInstallRequest struct {
 	Command       string
-	ClientOptions *installationProxyOption
+	ClientOptions *InstallOptions `plist:",omitempty"`
 	PackagePath   string
 }
 
@@ -42,12 +233,16 @@ type installationProxyOption struct {
 	BundleIDs             []string        `plist:",omitempty"`
 	BundleID              string          `plist:",omitempty"`
 	ApplicationIdentifier string          `plist:",omitempty"`
+	SkipUninstall         bool            `plist:",omitempty"`
+	ArchiveType           ArchiveType     `plist:",omitempty"`
 }
 
 type installationProxyInstallResponse struct {
 	Status           string
+	PercentComplete  int
 	Error            string
 	ErrorDescription string
+	ErrorDetail      int
 }
 
 type installationProxyUninstallRequest struct {
@@ -62,189 +257,333 @@ type installationProxyLookupRequest struct {
 }
 
 type installationProxyLookupResponse struct {
-	Status       string
-	LookupResult map[string]interface{}
+	Status           string
+	LookupResult     map[string]Application
+	Error            string
+	ErrorDescription string
+	ErrorDetail      int
+}
+
+type installationProxyArchiveRequest struct {
+	Command               string
+	ClientOptions         *installationProxyOption `plist:",omitempty"`
+	ApplicationIdentifier string
+}
+
+type installationProxyLookupArchivesRequest struct {
+	Command       string
+	ClientOptions *installationProxyOption `plist:",omitempty"`
+}
+
+type installationProxyLookupArchivesResponse struct {
+	Status           string
+	LookupResult     map[string]interface{}
+	Error            string
+	ErrorDescription string
+	ErrorDetail      int
+}
+
+type installationProxyCheckCapabilitiesRequest struct {
+	Command       string
+	ClientOptions *installationProxyOption `plist:",omitempty"`
+	Capabilities  []string
+}
+
+type installationProxyCheckCapabilitiesResponse struct {
+	Status           string
+	LookupResult     bool
+	Error            string
+	ErrorDescription string
+	ErrorDetail      int
+}
+
+type installationProxyBrowseRequest struct {
+	Command       string
+	ClientOptions *installationProxyOption
+}
+
+type installationProxyBrowseResponse struct {
+	Status           string
+	CurrentIndex     int
+	CurrentAmount    int
+	Total            int
+	CurrentList      []Application
+	Error            string
+	ErrorDescription string
+	ErrorDetail      int
 }
 
 type InstallationProxy struct {
 	conn net.Conn
 }
 
-func (p *InstallationProxy) UninstallApplication(bundleID string) error {
+func (p *InstallationProxy) UninstallApplication(bundleID string, progress ProgressFunc) error {
 	req := installationProxyUninstallRequest{
 		Command:               "Uninstall",
 		ApplicationIdentifier: bundleID,
 	}
-
-	payload, err := plist.Marshal(req, plist.XMLFormat)
-	if err != nil {
+	if err := sendPlist(p.conn, req); err != nil {
 		return err
 	}
 
-	log.Printf(">> %s\n", payload)
-
-	b := make([]byte, 4)
-	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+	return p.waitForCompletion("uninstall", progress)
+}
 
-	buf := &bytes.Buffer{}
+// InstallApplication installs the package at path, which is relative to the
+// AFC root, e.g. "PublicStaging/app.ipa".
+func (p *InstallationProxy) InstallApplication(path string, opts *InstallOptions, progress ProgressFunc) error {
+	req := installationProxyInstallRequest{
+		Command:       "Install",
+		ClientOptions: opts,
+		PackagePath:   path,
+	}
+	if err := sendPlist(p.conn, req); err != nil {
+		return err
+	}
 
-	buf.Write(b)
-	buf.Write(payload)
+	return p.waitForCompletion("install", progress)
+}
 
-	if _, err := p.conn.Write(buf.Bytes()); err != nil {
+// UpgradeApplication works like InstallApplication, but replaces an already
+// installed application while keeping its data.
+func (p *InstallationProxy) UpgradeApplication(path string, opts *InstallOptions, progress ProgressFunc) error {
+	req := installationProxyInstallRequest{
+		Command:       "Upgrade",
+		ClientOptions: opts,
+		PackagePath:   path,
+	}
+	if err := sendPlist(p.conn, req); err != nil {
 		return err
 	}
 
-	var resp installationProxyInstallResponse
-	for len(resp.Error) == 0 {
-		var respHeader header2
-		if err := binary.Read(p.conn, binary.BigEndian, &respHeader); err != nil {
-			return err
-		}
+	return p.waitForCompletion("upgrade", progress)
+}
 
-		respPayload := make([]byte, respHeader.Length)
-		if _, err := io.ReadFull(p.conn, respPayload); err != nil {
+// waitForCompletion reads status messages until the command either completes
+// or fails, reporting every intermediate status to progress.
+func (p *InstallationProxy) waitForCompletion(command string, progress ProgressFunc) error {
+	for {
+		var resp installationProxyInstallResponse
+		if err := receivePlist(p.conn, &resp); err != nil {
 			return err
 		}
 
-		log.Printf("<< %s\n", respPayload)
-
-		if _, err := plist.Unmarshal(respPayload, &resp); err != nil {
-			return err
+		if len(resp.Error) != 0 {
+			return &InstallError{command, resp.Status, resp.Error, resp.ErrorDescription, resp.ErrorDetail}
 		}
 
 		if resp.Status == "Complete" {
-			break
+			if progress != nil {
+				progress(resp.Status, 100)
+			}
+			return nil
+		}
+
+		if progress != nil {
+			progress(resp.Status, resp.PercentComplete)
 		}
 	}
+}
 
-	if len(resp.Error) != 0 {
-		return fmt.Errorf("uninstall: %s (err: %s, desc: %s)", resp.Status, resp.Error, resp.ErrorDescription)
+// LookupApplication returns the application with the given bundle ID.
+func (p *InstallationProxy) LookupApplication(bundleID string, attributes []string) (*Application, error) {
+	apps, err := p.LookupApplications([]string{bundleID}, attributes)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	if len(apps) == 0 {
+		return nil, fmt.Errorf("bundle does not exist")
+	}
+
+	return &apps[0], nil
 }
 
-func (p *InstallationProxy) InstallApplication(bundleID, path string) error {
-	req := installationProxyInstallRequest{
-		Command: "Install",
+// LookupApplications looks up several applications in a single request.
+// The applications are returned in the order of bundleIDs. Bundle IDs which
+// are not installed on the device are left out.
+func (p *InstallationProxy) LookupApplications(bundleIDs []string, attributes []string) ([]Application, error) {
+	if len(attributes) == 0 {
+		attributes = DefaultLookupAttributes
+	}
+
+	req := installationProxyLookupRequest{
+		Command: "Lookup",
 		ClientOptions: &installationProxyOption{
-			BundleID: bundleID,
+			BundleIDs:        bundleIDs,
+			ReturnAttributes: attributes,
+			ApplicationType:  ApplicationTypeAny,
 		},
-		PackagePath: path,
+	}
+	if err := sendPlist(p.conn, req); err != nil {
+		return nil, err
 	}
 
-	payload, err := plist.Marshal(req, plist.XMLFormat)
-	if err != nil {
-		return err
+	var resp installationProxyLookupResponse
+	if err := receivePlist(p.conn, &resp); err != nil {
+		return nil, err
 	}
 
-	log.Printf(">> %s\n", payload)
+	if len(resp.Error) != 0 {
+		return nil, &InstallError{"lookup", resp.Status, resp.Error, resp.ErrorDescription, resp.ErrorDetail}
+	}
 
-	b := make([]byte, 4)
-	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+	if resp.Status != "Complete" {
+		return nil, fmt.Errorf("lookup status: %s", resp.Status)
+	}
 
-	buf := &bytes.Buffer{}
+	apps := make([]Application, 0, len(bundleIDs))
+	for _, bundleID := range bundleIDs {
+		if app, ok := resp.LookupResult[bundleID]; ok {
+			apps = append(apps, app)
+		}
+	}
 
-	buf.Write(b)
-	buf.Write(payload)
+	return apps, nil
+}
 
-	if _, err := p.conn.Write(buf.Bytes()); err != nil {
-		return err
+// Browse returns all applications of the given type installed on the device.
+//
+// The device sends the list in batches, each tagged with the index of its
+// first item and the total amount of applications, followed by a final
+// message with the "Complete" status.
+func (p *InstallationProxy) Browse(appType ApplicationType, attributes []string) ([]Application, error) {
+	if appType == "" {
+		appType = ApplicationTypeAny
 	}
 
-	var resp installationProxyInstallResponse
-	for len(resp.Error) == 0 {
-		var respHeader header2
-		if err := binary.Read(p.conn, binary.BigEndian, &respHeader); err != nil {
-			return err
-		}
+	if len(attributes) == 0 {
+		attributes = DefaultLookupAttributes
+	}
 
-		respPayload := make([]byte, respHeader.Length)
-		if _, err := io.ReadFull(p.conn, respPayload); err != nil {
-			return err
+	req := installationProxyBrowseRequest{
+		Command: "Browse",
+		ClientOptions: &installationProxyOption{
+			ApplicationType:  appType,
+			ReturnAttributes: attributes,
+		},
+	}
+	if err := sendPlist(p.conn, req); err != nil {
+		return nil, err
+	}
+
+	var apps []Application
+	for {
+		var resp installationProxyBrowseResponse
+		if err := receivePlist(p.conn, &resp); err != nil {
+			return nil, err
 		}
 
-		log.Printf("<< %s\n", respPayload)
+		if len(resp.Error) != 0 {
+			return nil, &InstallError{"browse", resp.Status, resp.Error, resp.ErrorDescription, resp.ErrorDetail}
+		}
 
-		if _, err := plist.Unmarshal(respPayload, &resp); err != nil {
-			return err
+		if apps == nil && resp.Total > 0 {
+			apps = make([]Application, 0, resp.Total)
 		}
+		apps = append(apps, resp.CurrentList...)
 
 		if resp.Status == "Complete" {
 			break
 		}
 	}
 
-	if len(resp.Error) != 0 {
-		return fmt.Errorf("install: %s (err: %s, desc: %s)", resp.Status, resp.Error, resp.ErrorDescription)
-	}
-
-	return nil
+	return apps, nil
 }
 
-func (p *InstallationProxy) LookupApplication(bundleID string, attributes []string) (map[string]interface{}, error) {
-	if len(attributes) == 0 {
-		attributes = DefaultLookupAttributes
-	}
-
-	req := installationProxyLookupRequest{
-		Command: "Lookup",
+// Archive archives the application, and unless skipUninstall is set, removes
+// it from the device. The archive can later be restored with Restore.
+func (p *InstallationProxy) Archive(bundleID string, skipUninstall bool, archiveType ArchiveType, progress ProgressFunc) error {
+	req := installationProxyArchiveRequest{
+		Command: "Archive",
 		ClientOptions: &installationProxyOption{
-			BundleIDs:        []string{bundleID},
-			ReturnAttributes: attributes,
-			ApplicationType:  ApplicationTypeAny,
+			SkipUninstall: skipUninstall,
+			ArchiveType:   archiveType,
 		},
+		ApplicationIdentifier: bundleID,
 	}
-
-	payload, err := plist.Marshal(req, plist.XMLFormat)
-	if err != nil {
-		return nil, err
+	if err := sendPlist(p.conn, req); err != nil {
+		return err
 	}
 
-	log.Printf(">> %s\n", payload)
+	return p.waitForCompletion("archive", progress)
+}
+
+// Restore restores a previously archived application.
+func (p *InstallationProxy) Restore(bundleID string, progress ProgressFunc) error {
+	req := installationProxyArchiveRequest{
+		Command:               "Restore",
+		ApplicationIdentifier: bundleID,
+	}
+	if err := sendPlist(p.conn, req); err != nil {
+		return err
+	}
 
-	b := make([]byte, 4)
-	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+	return p.waitForCompletion("restore", progress)
+}
 
-	buf := &bytes.Buffer{}
+// RemoveArchive deletes the archive of the application from the device.
+func (p *InstallationProxy) RemoveArchive(bundleID string, progress ProgressFunc) error {
+	req := installationProxyArchiveRequest{
+		Command:               "RemoveArchive",
+		ApplicationIdentifier: bundleID,
+	}
+	if err := sendPlist(p.conn, req); err != nil {
+		return err
+	}
 
-	buf.Write(b)
-	buf.Write(payload)
+	return p.waitForCompletion("remove archive", progress)
+}
 
-	if _, err := p.conn.Write(buf.Bytes()); err != nil {
+// LookupArchives returns the archived applications on the device keyed by
+// their bundle ID.
+func (p *InstallationProxy) LookupArchives() (map[string]interface{}, error) {
+	req := installationProxyLookupArchivesRequest{
+		Command: "LookupArchives",
+	}
+	if err := sendPlist(p.conn, req); err != nil {
 		return nil, err
 	}
 
-	var respHeader header2
-	if err := binary.Read(p.conn, binary.BigEndian, &respHeader); err != nil {
+	var resp installationProxyLookupArchivesResponse
+	if err := receivePlist(p.conn, &resp); err != nil {
 		return nil, err
 	}
 
-	respPayload := make([]byte, respHeader.Length)
-	if _, err := io.ReadFull(p.conn, respPayload); err != nil {
-		return nil, err
+	if len(resp.Error) != 0 {
+		return nil, &InstallError{"lookup archives", resp.Status, resp.Error, resp.ErrorDescription, resp.ErrorDetail}
 	}
 
-	log.Printf("<< %s\n", respPayload)
+	if resp.Status != "Complete" {
+		return nil, fmt.Errorf("lookup archives status: %s", resp.Status)
+	}
 
-	var resp installationProxyLookupResponse
-	if _, err := plist.Unmarshal(respPayload, &resp); err != nil {
-		return nil, err
+	return resp.LookupResult, nil
+}
+
+// CheckCapabilitiesMatch reports whether the device has all of the given
+// capabilities, e.g. the UIRequiredDeviceCapabilities of an application.
+func (p *InstallationProxy) CheckCapabilitiesMatch(capabilities []string) (bool, error) {
+	req := installationProxyCheckCapabilitiesRequest{
+		Command:      "CheckCapabilitiesMatch",
+		Capabilities: capabilities,
+	}
+	if err := sendPlist(p.conn, req); err != nil {
+		return false, err
 	}
 
-	if resp.Status != "Complete" {
-		return nil, fmt.Errorf("lookup status: %s", resp.Status)
+	var resp installationProxyCheckCapabilitiesResponse
+	if err := receivePlist(p.conn, &resp); err != nil {
+		return false, err
 	}
 
-	if len(resp.LookupResult) == 0 {
-		return nil, fmt.Errorf("bundle does not exist")
+	if len(resp.Error) != 0 {
+		return false, &InstallError{"check capabilities", resp.Status, resp.Error, resp.ErrorDescription, resp.ErrorDetail}
 	}
 
-	data, ok := resp.LookupResult[bundleID].(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("lookup error: %v", err)
+	if resp.Status != "Complete" {
+		return false, fmt.Errorf("check capabilities status: %s", resp.Status)
 	}
 
-	return data, nil
+	return resp.LookupResult, nil
 }
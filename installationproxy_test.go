@@ -0,0 +1,70 @@
+package xcdevice
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestInstallErrorIs(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		err    *InstallError
+		target error
+		want   bool
+	}{
+		{
+			name:   "verification failed",
+			err:    &InstallError{Command: "install", Status: "Failed", Name: "ApplicationVerificationFailed"},
+			target: ErrApplicationVerificationFailed,
+			want:   true,
+		},
+		{
+			name:   "different sentinel",
+			err:    &InstallError{Command: "install", Status: "Failed", Name: "ApplicationVerificationFailed"},
+			target: ErrDeviceOSVersionTooLow,
+			want:   false,
+		},
+		{
+			name:   "unknown name",
+			err:    &InstallError{Command: "install", Status: "Failed", Name: "APIInternalError"},
+			target: ErrInstallProhibited,
+			want:   false,
+		},
+		{
+			name: "out of space",
+			err: &InstallError{
+				Command:     "install",
+				Status:      "Failed",
+				Name:        "PackageExtractionFailed",
+				Description: "Failed to extract package: No space left on device",
+			},
+			target: ErrInsufficientSpace,
+			want:   true,
+		},
+		{
+			name: "out of space is still an extraction failure",
+			err: &InstallError{
+				Command:     "install",
+				Status:      "Failed",
+				Name:        "PackageExtractionFailed",
+				Description: "Failed to extract package: No space left on device",
+			},
+			target: ErrPackageExtractionFailed,
+			want:   true,
+		},
+		{
+			name:   "other failure is not out of space",
+			err:    &InstallError{Command: "install", Status: "Failed", Name: "PackageExtractionFailed", Description: "Failed to extract package"},
+			target: ErrInsufficientSpace,
+			want:   false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := fmt.Errorf("wrapped: %w", tc.err)
+			if got := errors.Is(err, tc.target); got != tc.want {
+				t.Errorf("errors.Is(%v, %v) = %v, want %v", err, tc.target, got, tc.want)
+			}
+		})
+	}
+}
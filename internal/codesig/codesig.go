@@ -0,0 +1,40 @@
+// Package codesig defines the Mach-O load commands and code signature blob
+// constants shared by the machoinfo and codesign packages.
+package codesig
+
+import "debug/macho"
+
+// Load commands which are not defined by debug/macho.
+const (
+	LoadCmdCodeSignature    macho.LoadCmd = 0x1d
+	LoadCmdEncryptionInfo   macho.LoadCmd = 0x21
+	LoadCmdEncryptionInfo64 macho.LoadCmd = 0x2c
+)
+
+// Code signature blob magic numbers. Code signatures are always big-endian,
+// regardless of the byte order of the executable.
+const (
+	MagicRequirement          = 0xfade0c00
+	MagicRequirements         = 0xfade0c01
+	MagicCodeDirectory        = 0xfade0c02
+	MagicEmbeddedSignature    = 0xfade0cc0
+	MagicEmbeddedEntitlements = 0xfade7171
+	MagicEntitlementsDER      = 0xfade7172
+	MagicBlobWrapper          = 0xfade0b01
+)
+
+// Slots of the blobs in the embedded signature super blob. The negated slots
+// of the first few are also the special slots of the code directory, which
+// hold the hashes of data that is not part of the code.
+const (
+	SlotCodeDirectory   = 0
+	SlotInfo            = 1
+	SlotRequirements    = 2
+	SlotResourceDir     = 3
+	SlotEntitlements    = 5
+	SlotEntitlementsDER = 7
+	SlotSignature       = 0x10000
+)
+
+// SupportsTeamID is the first code directory version with a team ID.
+const SupportsTeamID = 0x20200
@@ -12,11 +12,22 @@ import (
 	"howett.net/plist"
 )
 
+// lockdownPort is the port lockdownd listens on.
+const lockdownPort = 62078
+
 type ServiceName string
 
 const (
 	ServiceNameInstallationProxy ServiceName = "com.apple.mobile.installation_proxy"
 	ServiceNameAFC               ServiceName = "com.apple.afc"
+	ServiceNameSyslogRelay       ServiceName = "com.apple.syslog_relay"
+	ServiceNameOSTraceRelay      ServiceName = "com.apple.os_trace_relay"
+	ServiceNameScreenshotr       ServiceName = "com.apple.mobile.screenshotr"
+	ServiceNameDiagnosticsRelay  ServiceName = "com.apple.mobile.diagnostics_relay"
+	ServiceNameImageMounter      ServiceName = "com.apple.mobile.mobile_image_mounter"
+
+	ServiceNameNotificationProxy         ServiceName = "com.apple.mobile.notification_proxy"
+	ServiceNameInsecureNotificationProxy ServiceName = "com.apple.mobile.insecure_notification_proxy"
 )
 
 // Lockdown is used to start services on the device.
@@ -32,19 +43,6 @@ type Lockdown struct {
 	sslHandshakes int
 }
 
-type connectRequest struct {
-	MessageType         string
-	ProgName            string
-	ClientVersionString string
-	DeviceID            int
-	PortNumber          uint16
-}
-
-type connectResponse struct {
-	MessageType string
-	Number      ReplyCode
-}
-
 type startSessionRequest struct {
 	Label           string
 	ProtocolVersion string
@@ -87,44 +85,81 @@ type startServiceResponse struct {
 	Service          string
 }
 
+type getValueRequest struct {
+	Label           string
+	ProtocolVersion string
+	Request         string
+	Domain          string `plist:",omitempty"`
+	Key             string `plist:",omitempty"`
+}
+
+type getValueResponse struct {
+	Request string
+	Error   string
+	Key     string
+	Value   interface{}
+}
+
 type header2 struct {
 	// Length is the lenght of the message including the header
 	Length uint32
 }
 
-func LockdownService(device *Device) (*Lockdown, error) {
-	conn, err := Open()
+// sendPlist writes v to w as an XML plist prefixed with a 32-bit big-endian
+// length. This is the framing used by lockdownd and most of the services
+// started through it.
+func sendPlist(w io.Writer, v interface{}) error {
+	payload, err := plist.Marshal(v, plist.XMLFormat)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Convert default lockdown port to network byte order
-	// 62078 => 32498
-	buf := make([]byte, 2)
-	binary.BigEndian.PutUint16(buf, 62078)
-	port := binary.LittleEndian.Uint16(buf)
+	log.Printf(">> %s\n", payload)
+
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+
+	buf := &bytes.Buffer{}
+
+	buf.Write(b)
+	buf.Write(payload)
 
-	req := connectRequest{
-		MessageType:         "Connect",
-		ProgName:            "xcdevice",
-		ClientVersionString: "xcdevice-0.0.1",
-		DeviceID:            device.DeviceID,
-		PortNumber:          port,
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
 	}
-	if err := conn.Send(req); err != nil {
-		return nil, err
+
+	return nil
+}
+
+// receivePlist reads a single length prefixed plist from r and decodes it
+// into v.
+func receivePlist(r io.Reader, v interface{}) error {
+	var respHeader header2
+	if err := binary.Read(r, binary.BigEndian, &respHeader); err != nil {
+		return err
 	}
 
-	resp := connectResponse{}
-	if err := conn.Receive(&resp); err != nil {
-		return nil, err
+	respPayload := make([]byte, respHeader.Length)
+	if _, err := io.ReadFull(r, respPayload); err != nil {
+		return err
 	}
 
-	if resp.Number != ReplyCodeOK {
-		return nil, fmt.Errorf("usbmuxd: %s", resp.Number.String())
+	log.Printf("<< %s\n", respPayload)
+
+	if _, err := plist.Unmarshal(respPayload, v); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func LockdownService(device *Device) (*Lockdown, error) {
+	conn, err := DialDevice(device, lockdownPort)
+	if err != nil {
+		return nil, err
 	}
 
-	return &Lockdown{conn.Hijack(), nil, device, "", 0}, nil
+	return &Lockdown{conn, nil, device, "", 0}, nil
 }
 
 func (l *Lockdown) Conn() net.Conn {
@@ -155,45 +190,28 @@ func (l *Lockdown) startService(service ServiceName) (net.Conn, error) {
 		return nil, fmt.Errorf("stop session: %v", err)
 	}
 
-	conn, err := Open()
+	conn, err := DialDevice(l.dev, dynamicPort)
 	if err != nil {
 		return nil, err
 	}
-	// defer conn.Close()
-
-	// Convert default lockdown port to network byte order
-	// 62078 => 32498
-	buf := make([]byte, 2)
-	binary.BigEndian.PutUint16(buf, uint16(dynamicPort))
-	port := binary.LittleEndian.Uint16(buf)
-
-	req := connectRequest{
-		MessageType:         "Connect",
-		ProgName:            "xcdevice",
-		ClientVersionString: "xcdevice-0.0.1",
-		DeviceID:            l.dev.DeviceID,
-		PortNumber:          port,
-	}
-	if err := conn.Send(req); err != nil {
-		return nil, err
-	}
 
-	resp := connectResponse{}
-	if err := conn.Receive(&resp); err != nil {
-		return nil, err
-	}
+	if enableSSL {
+		config, err := tlsConfig(pair)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
 
-	if resp.Number != ReplyCodeOK {
-		return nil, fmt.Errorf("lockdownd: %s", resp.Number.String())
-	}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake: %v", err)
+		}
 
-	if enableSSL {
-		// FIXME: maybe an abstraction for the connection can automatically
-		// 		  bootstrap tls?
-		return nil, fmt.Errorf("daemon requested ssl is unsupported")
+		return tlsConn, nil
 	}
 
-	return conn.Hijack(), nil
+	return conn, nil
 }
 
 func (l *Lockdown) startDaemon(service ServiceName) (int, bool, error) {
@@ -362,20 +380,30 @@ func (l *Lockdown) stopSession() error {
 	return nil
 }
 
-func (l *Lockdown) enableSSL(pair *PairRecord) error {
+// tlsConfig returns the TLS configuration for lockdownd sessions and the
+// services that request SSL, which authenticate the host with the root
+// certificate of the pair record.
+func tlsConfig(pair *PairRecord) (*tls.Config, error) {
 	minVersion := uint16(tls.VersionTLS11)
 	maxVersion := uint16(tls.VersionTLS13)
 
 	cert, err := tls.X509KeyPair(pair.RootCertificate, pair.RootPrivateKey)
 	if err != nil {
-		return fmt.Errorf("x509: %v", err)
+		return nil, fmt.Errorf("x509: %v", err)
 	}
 
-	config := &tls.Config{
+	return &tls.Config{
 		Certificates:       []tls.Certificate{cert},
 		InsecureSkipVerify: true,
 		MinVersion:         minVersion,
 		MaxVersion:         maxVersion,
+	}, nil
+}
+
+func (l *Lockdown) enableSSL(pair *PairRecord) error {
+	config, err := tlsConfig(pair)
+	if err != nil {
+		return err
 	}
 
 	l.tlsConn = tls.Client(l.conn, config)
@@ -387,6 +415,33 @@ func (l *Lockdown) enableSSL(pair *PairRecord) error {
 	return nil
 }
 
+// GetValue returns the value of key in the given domain. An empty domain
+// refers to the global domain, which has keys like "ProductVersion",
+// "DeviceClass" or "UniqueDeviceID".
+func (l *Lockdown) GetValue(domain, key string) (interface{}, error) {
+	req := getValueRequest{
+		Label:           "com.romantomjak.xcdevice",
+		ProtocolVersion: "2",
+		Request:         "GetValue",
+		Domain:          domain,
+		Key:             key,
+	}
+	if err := sendPlist(l.Conn(), req); err != nil {
+		return nil, err
+	}
+
+	resp := &getValueResponse{}
+	if err := receivePlist(l.Conn(), resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Error != "" {
+		return nil, fmt.Errorf("get value %s: %s", key, resp.Error)
+	}
+
+	return resp.Value, nil
+}
+
 func (l *Lockdown) InstallationProxyService() (*InstallationProxy, error) {
 	conn, err := l.startService(ServiceNameInstallationProxy)
 	if err != nil {
@@ -402,3 +457,62 @@ func (l *Lockdown) AFCService() (*AFC, error) {
 	}
 	return &AFC{conn, 0}, nil
 }
+
+func (l *Lockdown) SyslogRelayService() (*SyslogRelay, error) {
+	conn, err := l.startService(ServiceNameSyslogRelay)
+	if err != nil {
+		return nil, err
+	}
+	return newSyslogRelay(conn), nil
+}
+
+func (l *Lockdown) OSTraceRelayService() (*OSTraceRelay, error) {
+	conn, err := l.startService(ServiceNameOSTraceRelay)
+	if err != nil {
+		return nil, err
+	}
+	return newOSTraceRelay(conn), nil
+}
+
+func (l *Lockdown) ScreenshotrService() (*Screenshotr, error) {
+	conn, err := l.startService(ServiceNameScreenshotr)
+	if err != nil {
+		return nil, err
+	}
+	return newScreenshotr(conn)
+}
+
+func (l *Lockdown) DiagnosticsRelayService() (*DiagnosticsRelay, error) {
+	conn, err := l.startService(ServiceNameDiagnosticsRelay)
+	if err != nil {
+		return nil, err
+	}
+	return &DiagnosticsRelay{conn}, nil
+}
+
+func (l *Lockdown) NotificationProxyService() (*NotificationProxy, error) {
+	conn, err := l.startService(ServiceNameNotificationProxy)
+	if err != nil {
+		return nil, err
+	}
+	return newNotificationProxy(conn), nil
+}
+
+// InsecureNotificationProxyService starts the notification proxy which is
+// available before the device has been activated and only relays a limited
+// set of notifications.
+func (l *Lockdown) InsecureNotificationProxyService() (*NotificationProxy, error) {
+	conn, err := l.startService(ServiceNameInsecureNotificationProxy)
+	if err != nil {
+		return nil, err
+	}
+	return newNotificationProxy(conn), nil
+}
+
+func (l *Lockdown) ImageMounterService() (*ImageMounter, error) {
+	conn, err := l.startService(ServiceNameImageMounter)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageMounter{conn}, nil
+}
@@ -4,7 +4,7 @@ import (
 	"fmt"
 )
 
-func Lookup(device *Device, bundleID string, attributes []string) (map[string]interface{}, error) {
+func Lookup(device *Device, bundleIDs []string, attributes []string) ([]Application, error) {
 	lockdown, err := LockdownService(device)
 	if err != nil {
 		return nil, fmt.Errorf("lockdown: %v", err)
@@ -15,10 +15,10 @@ func Lookup(device *Device, bundleID string, attributes []string) (map[string]in
 		return nil, fmt.Errorf("installation proxy: %v", err)
 	}
 
-	info, err := installationProxy.LookupApplication(bundleID, attributes)
+	apps, err := installationProxy.LookupApplications(bundleIDs, attributes)
 	if err != nil {
 		return nil, err
 	}
 
-	return info, nil
+	return apps, nil
 }
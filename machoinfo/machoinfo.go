@@ -0,0 +1,348 @@
+// Package machoinfo inspects the Mach-O executable of an application bundle.
+package machoinfo
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/romantomjak/xcdevice/infoplist"
+	"github.com/romantomjak/xcdevice/internal/codesig"
+	"howett.net/plist"
+)
+
+// Info describes the executable of an application bundle.
+type Info struct {
+	// Name is the CFBundleExecutable of the application.
+	Name string
+
+	// Slices holds one entry per architecture. Thin executables have a
+	// single slice.
+	Slices []Slice
+}
+
+// Slice describes a single architecture of an executable.
+type Slice struct {
+	// Architecture is the name of the architecture, e.g. "arm64" or "arm64e".
+	Architecture string
+
+	// HasEncryptionInfo is set when the slice has an LC_ENCRYPTION_INFO
+	// load command. CryptID is non-zero when the slice is encrypted, which
+	// is the case for binaries downloaded from the App Store.
+	HasEncryptionInfo bool
+	CryptID           uint32
+
+	// Signed is set when the slice has an embedded code signature.
+	Signed bool
+
+	// Identifier and TeamID are taken from the code directory.
+	Identifier string
+	TeamID     string
+
+	// Entitlements are the entitlements the slice was signed with.
+	Entitlements map[string]interface{}
+}
+
+// Encrypted reports whether the slice is encrypted.
+func (s Slice) Encrypted() bool {
+	return s.CryptID != 0
+}
+
+// Architectures returns the architectures of all slices.
+func (i *Info) Architectures() []string {
+	archs := make([]string, 0, len(i.Slices))
+	for _, s := range i.Slices {
+		archs = append(archs, s.Architecture)
+	}
+	return archs
+}
+
+// Encrypted reports whether any of the slices is encrypted.
+func (i *Info) Encrypted() bool {
+	for _, s := range i.Slices {
+		if s.Encrypted() {
+			return true
+		}
+	}
+	return false
+}
+
+// HasArchitecture reports whether the executable contains a slice for arch.
+func (i *Info) HasArchitecture(arch string) bool {
+	for _, s := range i.Slices {
+		if s.Architecture == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// compatibleArchitectures maps device architectures, as reported by the
+// CPUArchitecture lockdown value, to the slice architectures they run.
+var compatibleArchitectures = map[string][]string{
+	"arm64e": {"arm64e", "arm64"},
+	"arm64":  {"arm64"},
+	"armv7s": {"armv7s", "armv7"},
+	"armv7":  {"armv7"},
+	"armv7k": {"armv7k"},
+}
+
+// RunsOn reports whether a device with the CPU architecture can run one of
+// the slices. Unknown architectures are assumed to be able to.
+func (i *Info) RunsOn(deviceArch string) bool {
+	archs, ok := compatibleArchitectures[deviceArch]
+	if !ok {
+		return true
+	}
+	for _, arch := range archs {
+		if i.HasArchitecture(arch) {
+			return true
+		}
+	}
+	return false
+}
+
+// Inspect opens the CFBundleExecutable of the specified IPA file or unpacked
+// .app directory.
+func Inspect(filename string) (*Info, error) {
+	pkg, err := infoplist.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer pkg.Close()
+
+	return InspectPackage(pkg)
+}
+
+// InspectPackage opens the CFBundleExecutable of the application in pkg.
+func InspectPackage(pkg *infoplist.Package) (*Info, error) {
+	info, err := pkg.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	name, ok := info[infoplist.PlistKeyBundleExecutable].(string)
+	if !ok {
+		return nil, fmt.Errorf("missing %s", infoplist.PlistKeyBundleExecutable)
+	}
+
+	// only the headers, load commands and signature are read
+	r, size, err := pkg.OpenReaderAt(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	slices, err := Parse(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return &Info{Name: name, Slices: slices}, nil
+}
+
+// Parse inspects a thin or fat Mach-O file, which is size bytes long.
+func Parse(r io.ReaderAt, size int64) ([]Slice, error) {
+	ff, err := macho.NewFatFile(r)
+	if err != nil {
+		if !errors.Is(err, macho.ErrNotFat) {
+			return nil, err
+		}
+
+		s, err := parseSlice(r, size)
+		if err != nil {
+			return nil, err
+		}
+		return []Slice{s}, nil
+	}
+
+	slices := make([]Slice, 0, len(ff.Arches))
+	for _, arch := range ff.Arches {
+		if uint64(arch.Offset)+uint64(arch.Size) > uint64(size) {
+			return nil, fmt.Errorf("slice %s out of range", arch.Cpu)
+		}
+		s, err := parseSlice(io.NewSectionReader(r, int64(arch.Offset), int64(arch.Size)), int64(arch.Size))
+		if err != nil {
+			return nil, err
+		}
+		slices = append(slices, s)
+	}
+
+	return slices, nil
+}
+
+func parseSlice(r io.ReaderAt, size int64) (Slice, error) {
+	f, err := macho.NewFile(r)
+	if err != nil {
+		return Slice{}, err
+	}
+	defer f.Close()
+
+	s := Slice{
+		Architecture: architecture(f.Cpu, f.SubCpu),
+	}
+
+	for _, l := range f.Loads {
+		raw := l.Raw()
+		if len(raw) < 8 {
+			continue
+		}
+
+		switch macho.LoadCmd(f.ByteOrder.Uint32(raw)) {
+		case codesig.LoadCmdEncryptionInfo, codesig.LoadCmdEncryptionInfo64:
+			// cmd, cmdsize, cryptoff, cryptsize, cryptid
+			if len(raw) < 20 {
+				return Slice{}, fmt.Errorf("invalid encryption info load command")
+			}
+			s.HasEncryptionInfo = true
+			s.CryptID = f.ByteOrder.Uint32(raw[16:])
+
+		case codesig.LoadCmdCodeSignature:
+			// cmd, cmdsize, dataoff, datasize
+			if len(raw) < 16 {
+				return Slice{}, fmt.Errorf("invalid code signature load command")
+			}
+			offset := f.ByteOrder.Uint32(raw[8:])
+			length := f.ByteOrder.Uint32(raw[12:])
+
+			// check the bounds before allocating, the length is read from
+			// the file
+			if int64(offset)+int64(length) > size {
+				return Slice{}, fmt.Errorf("code signature out of range")
+			}
+
+			signature := make([]byte, length)
+			if _, err := r.ReadAt(signature, int64(offset)); err != nil {
+				return Slice{}, fmt.Errorf("read code signature: %v", err)
+			}
+
+			if err := parseSignature(&s, signature); err != nil {
+				return Slice{}, fmt.Errorf("code signature: %v", err)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// parseSignature reads the code directory and entitlements blobs from an
+// embedded signature super blob.
+func parseSignature(s *Slice, b []byte) error {
+	if len(b) < 12 || binary.BigEndian.Uint32(b) != codesig.MagicEmbeddedSignature {
+		return fmt.Errorf("invalid embedded signature")
+	}
+	s.Signed = true
+
+	count := binary.BigEndian.Uint32(b[8:])
+	for i := uint32(0); i < count; i++ {
+		index := 12 + 8*int(i)
+		if index+8 > len(b) {
+			return fmt.Errorf("truncated blob index")
+		}
+		slot := binary.BigEndian.Uint32(b[index:])
+		offset := binary.BigEndian.Uint32(b[index+4:])
+
+		blob, err := blobAt(b, offset)
+		if err != nil {
+			return err
+		}
+
+		switch binary.BigEndian.Uint32(blob) {
+		case codesig.MagicCodeDirectory:
+			// alternate code directories carry the same identifiers
+			if slot != codesig.SlotCodeDirectory {
+				continue
+			}
+			if err := parseCodeDirectory(s, blob); err != nil {
+				return err
+			}
+
+		case codesig.MagicEmbeddedEntitlements:
+			entitlements := make(map[string]interface{}, 0)
+			if _, err := plist.Unmarshal(blob[8:], &entitlements); err != nil {
+				return fmt.Errorf("entitlements: %v", err)
+			}
+			s.Entitlements = entitlements
+		}
+	}
+
+	return nil
+}
+
+// blobAt returns the blob at offset, which starts with its magic and length.
+func blobAt(b []byte, offset uint32) ([]byte, error) {
+	if uint64(offset)+8 > uint64(len(b)) {
+		return nil, fmt.Errorf("blob offset out of range")
+	}
+	length := binary.BigEndian.Uint32(b[offset+4:])
+	if length < 8 || uint64(offset)+uint64(length) > uint64(len(b)) {
+		return nil, fmt.Errorf("blob length out of range")
+	}
+	return b[offset : offset+length], nil
+}
+
+func parseCodeDirectory(s *Slice, cd []byte) error {
+	if len(cd) < 44 {
+		return fmt.Errorf("truncated code directory")
+	}
+
+	version := binary.BigEndian.Uint32(cd[8:])
+
+	identOffset := binary.BigEndian.Uint32(cd[20:])
+	s.Identifier = cString(cd, identOffset)
+
+	if version >= codesig.SupportsTeamID && len(cd) >= 52 {
+		if teamOffset := binary.BigEndian.Uint32(cd[48:]); teamOffset != 0 {
+			s.TeamID = cString(cd, teamOffset)
+		}
+	}
+
+	return nil
+}
+
+// cString returns the NUL terminated string at offset.
+func cString(b []byte, offset uint32) string {
+	if uint64(offset) >= uint64(len(b)) {
+		return ""
+	}
+	s := b[offset:]
+	if i := bytes.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return string(s)
+}
+
+// architecture returns the conventional name of a cpu type and subtype.
+func architecture(cpu macho.Cpu, subCpu uint32) string {
+	// the upper bits of the subtype hold capability flags
+	subCpu &= 0x00ffffff
+
+	switch cpu {
+	case macho.CpuArm64:
+		if subCpu == 2 {
+			return "arm64e"
+		}
+		return "arm64"
+	case macho.CpuArm:
+		switch subCpu {
+		case 6:
+			return "armv6"
+		case 9:
+			return "armv7"
+		case 11:
+			return "armv7s"
+		case 12:
+			return "armv7k"
+		}
+		return "arm"
+	case macho.CpuAmd64:
+		return "x86_64"
+	case macho.Cpu386:
+		return "i386"
+	}
+
+	return cpu.String()
+}
@@ -0,0 +1,421 @@
+package machoinfo
+
+import (
+	"archive/zip"
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/romantomjak/xcdevice/infoplist"
+	"github.com/romantomjak/xcdevice/internal/codesig"
+	"howett.net/plist"
+)
+
+const fixtureTextSize = 0x1000
+
+// sliceFixture describes a thin Mach-O file built by machoFixture.
+type sliceFixture struct {
+	cpu    macho.Cpu
+	subCpu uint32
+	is32   bool
+
+	// encryption is the encryption info load command to add, if any.
+	encryption macho.LoadCmd
+	cryptID    uint32
+
+	// signature is placed after __TEXT and referenced by LC_CODE_SIGNATURE
+	// when it is not nil.
+	signature []byte
+}
+
+// machoFixture returns a minimal executable with a __TEXT segment and the
+// load commands of the fixture.
+func machoFixture(f sliceFixture) []byte {
+	le := binary.LittleEndian
+	cmds := &bytes.Buffer{}
+	ncmds := uint32(0)
+
+	if f.is32 {
+		b := make([]byte, 56)
+		le.PutUint32(b, uint32(macho.LoadCmdSegment))
+		le.PutUint32(b[4:], 56)
+		copy(b[8:24], "__TEXT")
+		le.PutUint32(b[28:], fixtureTextSize) // vmsize
+		le.PutUint32(b[36:], fixtureTextSize) // filesize
+		cmds.Write(b)
+	} else {
+		b := make([]byte, 72)
+		le.PutUint32(b, uint32(macho.LoadCmdSegment64))
+		le.PutUint32(b[4:], 72)
+		copy(b[8:24], "__TEXT")
+		le.PutUint64(b[32:], fixtureTextSize) // vmsize
+		le.PutUint64(b[48:], fixtureTextSize) // filesize
+		cmds.Write(b)
+	}
+	ncmds++
+
+	if f.encryption != 0 {
+		size := 24
+		if f.is32 {
+			size = 20
+		}
+		b := make([]byte, size)
+		le.PutUint32(b, uint32(f.encryption))
+		le.PutUint32(b[4:], uint32(size))
+		le.PutUint32(b[8:], 0x400)
+		le.PutUint32(b[12:], 0xc00)
+		le.PutUint32(b[16:], f.cryptID)
+		cmds.Write(b)
+		ncmds++
+	}
+
+	if f.signature != nil {
+		b := make([]byte, 16)
+		le.PutUint32(b, uint32(codesig.LoadCmdCodeSignature))
+		le.PutUint32(b[4:], 16)
+		le.PutUint32(b[8:], fixtureTextSize)
+		le.PutUint32(b[12:], uint32(len(f.signature)))
+		cmds.Write(b)
+		ncmds++
+	}
+
+	data := make([]byte, fixtureTextSize+len(f.signature))
+	headerSize := 32
+	if f.is32 {
+		le.PutUint32(data, macho.Magic32)
+		headerSize = 28
+	} else {
+		le.PutUint32(data, macho.Magic64)
+	}
+	le.PutUint32(data[4:], uint32(f.cpu))
+	le.PutUint32(data[8:], f.subCpu)
+	le.PutUint32(data[12:], uint32(macho.TypeExec))
+	le.PutUint32(data[16:], ncmds)
+	le.PutUint32(data[20:], uint32(cmds.Len()))
+	copy(data[headerSize:], cmds.Bytes())
+	copy(data[fixtureTextSize:], f.signature)
+
+	return data
+}
+
+// fatFixture combines thin files into a fat file with 16 KiB aligned slices.
+func fatFixture(slices ...[]byte) []byte {
+	const align = 14
+
+	header := make([]byte, 8+20*len(slices))
+	binary.BigEndian.PutUint32(header, macho.MagicFat)
+	binary.BigEndian.PutUint32(header[4:], uint32(len(slices)))
+
+	out := &bytes.Buffer{}
+	out.Write(header)
+	for i, s := range slices {
+		offset := (out.Len() + 1<<align - 1) &^ (1<<align - 1)
+		out.Write(make([]byte, offset-out.Len()))
+
+		h := out.Bytes()[8+20*i:]
+		binary.BigEndian.PutUint32(h, binary.LittleEndian.Uint32(s[4:]))
+		binary.BigEndian.PutUint32(h[4:], binary.LittleEndian.Uint32(s[8:]))
+		binary.BigEndian.PutUint32(h[8:], uint32(offset))
+		binary.BigEndian.PutUint32(h[12:], uint32(len(s)))
+		binary.BigEndian.PutUint32(h[16:], align)
+
+		out.Write(s)
+	}
+
+	return out.Bytes()
+}
+
+// blob prefixes data with a blob header.
+func blob(magic uint32, data []byte) []byte {
+	b := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(b, magic)
+	binary.BigEndian.PutUint32(b[4:], uint32(8+len(data)))
+	return append(b, data...)
+}
+
+// codeDirectory returns a code directory without hashes, which is all
+// parseCodeDirectory looks at.
+func codeDirectory(version uint32, identifier, teamID string) []byte {
+	const headerSize = 52
+
+	cd := make([]byte, headerSize-8)
+	binary.BigEndian.PutUint32(cd, version)
+	binary.BigEndian.PutUint32(cd[12:], headerSize) // identOffset
+	strs := identifier + "\x00"
+	if teamID != "" {
+		binary.BigEndian.PutUint32(cd[40:], uint32(headerSize+len(strs))) // teamOffset
+		strs += teamID + "\x00"
+	}
+
+	return blob(codesig.MagicCodeDirectory, append(cd, strs...))
+}
+
+type slotBlob struct {
+	slot uint32
+	data []byte
+}
+
+// superBlob returns an embedded signature holding the blobs.
+func superBlob(blobs ...slotBlob) []byte {
+	index := make([]byte, 4, 4+8*len(blobs))
+	binary.BigEndian.PutUint32(index, uint32(len(blobs)))
+
+	offset := 12 + 8*len(blobs)
+	var contents []byte
+	for _, b := range blobs {
+		entry := make([]byte, 8)
+		binary.BigEndian.PutUint32(entry, b.slot)
+		binary.BigEndian.PutUint32(entry[4:], uint32(offset+len(contents)))
+		index = append(index, entry...)
+		contents = append(contents, b.data...)
+	}
+
+	return blob(codesig.MagicEmbeddedSignature, append(index, contents...))
+}
+
+func entitlementsBlob(t *testing.T, entitlements map[string]interface{}) []byte {
+	t.Helper()
+
+	b, err := plist.Marshal(entitlements, plist.XMLFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob(codesig.MagicEmbeddedEntitlements, b)
+}
+
+func TestParse(t *testing.T) {
+	entitlements := map[string]interface{}{
+		"application-identifier": "ABCDE12345.com.example.app",
+		"get-task-allow":         true,
+	}
+	signature := superBlob(
+		slotBlob{codesig.SlotCodeDirectory, codeDirectory(codesig.SupportsTeamID, "com.example.app", "ABCDE12345")},
+		slotBlob{codesig.SlotEntitlements, entitlementsBlob(t, entitlements)},
+		// alternate code directories are ignored
+		slotBlob{0x1000, codeDirectory(codesig.SupportsTeamID, "alternate", "ALTERNATE")},
+	)
+
+	arm64 := sliceFixture{cpu: macho.CpuArm64}
+	signed := arm64
+	signed.signature = signature
+
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		want []Slice
+	}{
+		{
+			name: "unsigned",
+			in:   machoFixture(arm64),
+			want: []Slice{{Architecture: "arm64"}},
+		},
+		{
+			name: "signed",
+			in:   machoFixture(signed),
+			want: []Slice{{
+				Architecture: "arm64",
+				Signed:       true,
+				Identifier:   "com.example.app",
+				TeamID:       "ABCDE12345",
+				Entitlements: entitlements,
+			}},
+		},
+		{
+			name: "code directory without team ID",
+			in: machoFixture(sliceFixture{
+				cpu:       macho.CpuArm64,
+				signature: superBlob(slotBlob{codesig.SlotCodeDirectory, codeDirectory(0x20100, "com.example.app", "")}),
+			}),
+			want: []Slice{{Architecture: "arm64", Signed: true, Identifier: "com.example.app"}},
+		},
+		{
+			name: "encrypted",
+			in:   machoFixture(sliceFixture{cpu: macho.CpuArm64, encryption: codesig.LoadCmdEncryptionInfo64, cryptID: 1}),
+			want: []Slice{{Architecture: "arm64", HasEncryptionInfo: true, CryptID: 1}},
+		},
+		{
+			name: "decrypted",
+			in:   machoFixture(sliceFixture{cpu: macho.CpuArm64, encryption: codesig.LoadCmdEncryptionInfo64}),
+			want: []Slice{{Architecture: "arm64", HasEncryptionInfo: true}},
+		},
+		{
+			name: "32-bit encrypted",
+			in:   machoFixture(sliceFixture{cpu: macho.CpuArm, subCpu: 9, is32: true, encryption: codesig.LoadCmdEncryptionInfo, cryptID: 1}),
+			want: []Slice{{Architecture: "armv7", HasEncryptionInfo: true, CryptID: 1}},
+		},
+		{
+			name: "arm64e with capability bits",
+			in:   machoFixture(sliceFixture{cpu: macho.CpuArm64, subCpu: 0x80000002}),
+			want: []Slice{{Architecture: "arm64e"}},
+		},
+		{
+			name: "fat",
+			in: fatFixture(
+				machoFixture(sliceFixture{cpu: macho.CpuArm, subCpu: 11, is32: true}),
+				machoFixture(signed),
+				machoFixture(sliceFixture{cpu: macho.CpuArm64, subCpu: 2, encryption: codesig.LoadCmdEncryptionInfo64, cryptID: 1}),
+			),
+			want: []Slice{
+				{Architecture: "armv7s"},
+				{
+					Architecture: "arm64",
+					Signed:       true,
+					Identifier:   "com.example.app",
+					TeamID:       "ABCDE12345",
+					Entitlements: entitlements,
+				},
+				{Architecture: "arm64e", HasEncryptionInfo: true, CryptID: 1},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			slices, err := Parse(bytes.NewReader(tc.in), int64(len(tc.in)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(slices, tc.want) {
+				t.Errorf("slices = %+v, want %+v", slices, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	withSignature := func(signature []byte) []byte {
+		return machoFixture(sliceFixture{cpu: macho.CpuArm64, signature: signature})
+	}
+
+	// a code signature load command pointing past the end of the file
+	outOfRange := withSignature(superBlob())
+	binary.LittleEndian.PutUint32(outOfRange[32+72+12:], 0x7fffffff)
+
+	// a fat header whose slice is larger than the file
+	fatOutOfRange := fatFixture(machoFixture(sliceFixture{cpu: macho.CpuArm64}))
+	binary.BigEndian.PutUint32(fatOutOfRange[8+12:], 0x100000)
+
+	truncatedIndex := superBlob()
+	binary.BigEndian.PutUint32(truncatedIndex[8:], 4)
+
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		err  string
+	}{
+		{"empty", nil, "magic number"},
+		{"not a Mach-O file", []byte("not a mach-o file"), "invalid magic number"},
+		{"truncated header", machoFixture(sliceFixture{cpu: macho.CpuArm64})[:20], "EOF"},
+		{"truncated fat header", fatFixture(machoFixture(sliceFixture{cpu: macho.CpuArm64}))[:16], "fat_arch header"},
+		{"fat slice out of range", fatOutOfRange, "out of range"},
+		{"code signature out of range", outOfRange, "code signature out of range"},
+		{"invalid signature magic", withSignature(blob(0x12345678, make([]byte, 8))), "invalid embedded signature"},
+		{"truncated signature", withSignature([]byte{0xfa, 0xde}), "invalid embedded signature"},
+		{"truncated blob index", withSignature(truncatedIndex), "truncated blob index"},
+		{
+			"blob offset out of range",
+			withSignature(superBlob(slotBlob{codesig.SlotCodeDirectory, nil})),
+			"blob offset out of range",
+		},
+		{
+			"blob length out of range",
+			withSignature(superBlob(slotBlob{codesig.SlotCodeDirectory, []byte{0xfa, 0xde, 0x0c, 0x02, 0, 0, 0x10, 0}})),
+			"blob length out of range",
+		},
+		{
+			"truncated code directory",
+			withSignature(superBlob(slotBlob{codesig.SlotCodeDirectory, blob(codesig.MagicCodeDirectory, make([]byte, 8))})),
+			"truncated code directory",
+		},
+		{
+			"invalid entitlements",
+			withSignature(superBlob(slotBlob{codesig.SlotEntitlements, blob(codesig.MagicEmbeddedEntitlements, []byte("<plist><dict>"))})),
+			"entitlements",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse(bytes.NewReader(tc.in), int64(len(tc.in)))
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("err = %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestInfo(t *testing.T) {
+	info := &Info{Slices: []Slice{
+		{Architecture: "armv7"},
+		{Architecture: "arm64"},
+	}}
+
+	if got, want := info.Architectures(), []string{"armv7", "arm64"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Architectures = %v, want %v", got, want)
+	}
+	if !info.HasArchitecture("arm64") || info.HasArchitecture("arm64e") {
+		t.Error("HasArchitecture")
+	}
+	if info.Encrypted() {
+		t.Error("Encrypted = true")
+	}
+
+	for arch, want := range map[string]bool{
+		"arm64e":  true,
+		"arm64":   true,
+		"armv7s":  true,
+		"armv7":   true,
+		"armv7k":  false,
+		"unknown": true,
+	} {
+		if got := info.RunsOn(arch); got != want {
+			t.Errorf("RunsOn(%q) = %v, want %v", arch, got, want)
+		}
+	}
+
+	arm64e := &Info{Slices: []Slice{{Architecture: "arm64e", CryptID: 1}}}
+	if arm64e.RunsOn("arm64") {
+		t.Error("arm64e only executable runs on arm64")
+	}
+	if !arm64e.RunsOn("arm64e") {
+		t.Error("arm64e executable does not run on arm64e")
+	}
+	if !arm64e.Encrypted() {
+		t.Error("Encrypted = false")
+	}
+}
+
+func TestInspectPackage(t *testing.T) {
+	info, err := plist.Marshal(map[string]interface{}{"CFBundleExecutable": "Test"}, plist.XMLFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for name, data := range map[string][]byte{
+		"Payload/Test.app/Info.plist": info,
+		"Payload/Test.app/Test":       machoFixture(sliceFixture{cpu: macho.CpuArm64, encryption: codesig.LoadCmdEncryptionInfo64, cryptID: 1}),
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg, err := infoplist.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := InspectPackage(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "Test" || !got.Encrypted() || !reflect.DeepEqual(got.Architectures(), []string{"arm64"}) {
+		t.Errorf("info = %+v", got)
+	}
+}
@@ -0,0 +1,232 @@
+package xcdevice
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Darwin notifications posted by the device which are commonly observed.
+const (
+	NotificationApplicationInstalled   = "com.apple.mobile.application_installed"
+	NotificationApplicationUninstalled = "com.apple.mobile.application_uninstalled"
+	NotificationLockComplete           = "com.apple.springboard.lockcomplete"
+	NotificationLockState              = "com.apple.springboard.lockstate"
+	NotificationSyncWillStart          = "com.apple.itunes-mobdev.syncWillStart"
+	NotificationSyncDidStart           = "com.apple.itunes-mobdev.syncDidStart"
+	NotificationSyncDidFinish          = "com.apple.itunes-mobdev.syncDidFinish"
+	NotificationLanguageChanged        = "com.apple.language.changed"
+	NotificationDeviceNameChanged      = "com.apple.mobile.lockdown.device_name_changed"
+)
+
+// notificationProxyCloseTimeout is how long Close waits for the proxy to
+// acknowledge the shutdown.
+const notificationProxyCloseTimeout = time.Second
+
+type notificationProxyRequest struct {
+	Command string
+	Name    string `plist:",omitempty"`
+}
+
+type notificationProxyMessage struct {
+	Command string
+	Name    string
+}
+
+// NotificationProxy is a client of com.apple.mobile.notification_proxy,
+// which posts Darwin notifications on the device and relays the ones the
+// client observes.
+type NotificationProxy struct {
+	conn net.Conn
+
+	// mu serializes writes to conn
+	mu sync.Mutex
+
+	notifications chan string
+	done          chan struct{}
+	stopped       chan struct{}
+	err           error
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newNotificationProxy(conn net.Conn) *NotificationProxy {
+	p := &NotificationProxy{
+		conn:          conn,
+		notifications: make(chan string, 16),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	go p.receive()
+	return p
+}
+
+// PostNotification posts a Darwin notification on the device.
+func PostNotification(device *Device, name string) error {
+	return postNotification(device, name, false)
+}
+
+// PostInsecureNotification works like PostNotification, but uses the
+// insecure notification proxy, which is available before the device has
+// been activated.
+func PostInsecureNotification(device *Device, name string) error {
+	return postNotification(device, name, true)
+}
+
+// ObserveNotifications starts observing the Darwin notifications. Received
+// notifications are read from the Notifications channel until the proxy is
+// closed.
+func ObserveNotifications(device *Device, names ...string) (*NotificationProxy, error) {
+	return observeNotifications(device, names, false)
+}
+
+// ObserveInsecureNotifications works like ObserveNotifications, but uses the
+// insecure notification proxy, which only relays a limited set of
+// notifications.
+func ObserveInsecureNotifications(device *Device, names ...string) (*NotificationProxy, error) {
+	return observeNotifications(device, names, true)
+}
+
+func postNotification(device *Device, name string, insecure bool) error {
+	proxy, err := notificationProxyService(device, insecure)
+	if err != nil {
+		return err
+	}
+	defer proxy.Close()
+
+	return proxy.PostNotification(name)
+}
+
+func observeNotifications(device *Device, names []string, insecure bool) (*NotificationProxy, error) {
+	proxy, err := notificationProxyService(device, insecure)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := proxy.ObserveNotification(names...); err != nil {
+		proxy.Close()
+		return nil, err
+	}
+
+	return proxy, nil
+}
+
+func notificationProxyService(device *Device, insecure bool) (*NotificationProxy, error) {
+	lockdown, err := LockdownService(device)
+	if err != nil {
+		return nil, fmt.Errorf("lockdown: %v", err)
+	}
+
+	var proxy *NotificationProxy
+	if insecure {
+		proxy, err = lockdown.InsecureNotificationProxyService()
+	} else {
+		proxy, err = lockdown.NotificationProxyService()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("notification proxy: %v", err)
+	}
+
+	return proxy, nil
+}
+
+// PostNotification posts a Darwin notification on the device.
+func (p *NotificationProxy) PostNotification(name string) error {
+	return p.send(notificationProxyRequest{Command: "PostNotification", Name: name})
+}
+
+// ObserveNotification asks the device to relay the notifications to the
+// Notifications channel.
+func (p *NotificationProxy) ObserveNotification(names ...string) error {
+	for _, name := range names {
+		if err := p.send(notificationProxyRequest{Command: "ObserveNotification", Name: name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Notifications returns the channel of received notification names. It is
+// closed when the connection ends, Err returns why.
+func (p *NotificationProxy) Notifications() <-chan string {
+	return p.notifications
+}
+
+// Err returns the error that ended the connection once the Notifications
+// channel is closed. It is nil if the proxy was closed.
+func (p *NotificationProxy) Err() error {
+	select {
+	case <-p.stopped:
+		return p.err
+	default:
+		return nil
+	}
+}
+
+// Close shuts the proxy down and closes the connection. Notifications that
+// are received while closing are dropped. Calling Close again returns the
+// result of the first call.
+func (p *NotificationProxy) Close() error {
+	p.closeOnce.Do(func() {
+		p.closeErr = p.close()
+	})
+	return p.closeErr
+}
+
+func (p *NotificationProxy) close() error {
+	close(p.done)
+
+	err := p.send(notificationProxyRequest{Command: "Shutdown"})
+	if err == nil {
+		// the proxy acknowledges the shutdown with ProxyDeath
+		select {
+		case <-p.stopped:
+		case <-time.After(notificationProxyCloseTimeout):
+		}
+	}
+
+	if cerr := p.conn.Close(); err == nil {
+		err = cerr
+	}
+	<-p.stopped
+
+	return err
+}
+
+func (p *NotificationProxy) send(req notificationProxyRequest) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return sendPlist(p.conn, req)
+}
+
+// receive reads the messages of the proxy until it dies or the connection
+// is closed.
+func (p *NotificationProxy) receive() {
+	defer close(p.stopped)
+	defer close(p.notifications)
+
+	for {
+		msg := &notificationProxyMessage{}
+		if err := receivePlist(p.conn, msg); err != nil {
+			select {
+			case <-p.done:
+			default:
+				p.err = err
+			}
+			return
+		}
+
+		switch msg.Command {
+		case "RelayNotification":
+			select {
+			case p.notifications <- msg.Name:
+			case <-p.done:
+			}
+		case "ProxyDeath":
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package xcdevice
+
+import (
+	"io"
+	"log"
+	"net"
+	"testing"
+)
+
+func TestNotificationProxy(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	client, device := net.Pipe()
+	defer device.Close()
+
+	// the device relays one notification and acknowledges the shutdown
+	go func() {
+		req := &notificationProxyRequest{}
+		if err := receivePlist(device, req); err != nil || req.Command != "ObserveNotification" {
+			return
+		}
+		sendPlist(device, notificationProxyMessage{Command: "RelayNotification", Name: req.Name})
+
+		if err := receivePlist(device, req); err != nil || req.Command != "Shutdown" {
+			return
+		}
+		sendPlist(device, notificationProxyMessage{Command: "ProxyDeath"})
+	}()
+
+	proxy := newNotificationProxy(client)
+	if err := proxy.ObserveNotification(NotificationLockState); err != nil {
+		t.Fatal(err)
+	}
+
+	if name := <-proxy.Notifications(); name != NotificationLockState {
+		t.Errorf("notification = %q, want %q", name, NotificationLockState)
+	}
+
+	if err := proxy.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if err := proxy.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	if _, ok := <-proxy.Notifications(); ok {
+		t.Error("Notifications is not closed")
+	}
+	if err := proxy.Err(); err != nil {
+		t.Errorf("Err = %v, want nil after Close", err)
+	}
+}
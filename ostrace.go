@@ -0,0 +1,440 @@
+package xcdevice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"howett.net/plist"
+)
+
+// OSLogLevel is the level of a unified log entry.
+type OSLogLevel uint8
+
+const (
+	OSLogLevelNotice     OSLogLevel = 0x00
+	OSLogLevelInfo       OSLogLevel = 0x01
+	OSLogLevelDebug      OSLogLevel = 0x02
+	OSLogLevelUserAction OSLogLevel = 0x03
+	OSLogLevelError      OSLogLevel = 0x10
+	OSLogLevelFault      OSLogLevel = 0x11
+)
+
+func (l OSLogLevel) String() string {
+	switch l {
+	case OSLogLevelNotice:
+		return "Notice"
+	case OSLogLevelInfo:
+		return "Info"
+	case OSLogLevelDebug:
+		return "Debug"
+	case OSLogLevelUserAction:
+		return "User Action"
+	case OSLogLevelError:
+		return "Error"
+	case OSLogLevelFault:
+		return "Fault"
+	}
+	return fmt.Sprintf("Level(%d)", uint8(l))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (l OSLogLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// ErrActivityNotStarted is returned by Next when StartActivity has not been
+// called on the relay.
+var ErrActivityNotStarted = errors.New("activity not started")
+
+// OSLogEntry is a single entry of the unified log.
+type OSLogEntry struct {
+	Time  time.Time
+	PID   int
+	Level OSLogLevel
+
+	// Filename is the path of the executable of the process.
+	Filename string
+
+	// ImageName is the path of the library or executable that logged the
+	// message.
+	ImageName string
+
+	Message   string
+	Subsystem string `json:",omitempty"`
+	Category  string `json:",omitempty"`
+}
+
+// Process returns the name of the process that logged the entry.
+func (e *OSLogEntry) Process() string {
+	return path.Base(e.Filename)
+}
+
+func (e *OSLogEntry) String() string {
+	process := e.Process()
+	if image := path.Base(e.ImageName); e.ImageName != "" && image != process {
+		process += "(" + image + ")"
+	}
+
+	label := ""
+	if e.Subsystem != "" {
+		label = fmt.Sprintf("[%s:%s] ", e.Subsystem, e.Category)
+	}
+
+	return fmt.Sprintf("%s %s[%d] <%s>: %s%s",
+		e.Time.Format("Jan _2 15:04:05.000000"), process, e.PID, e.Level, label, e.Message)
+}
+
+// OSProcess is a process running on the device.
+type OSProcess struct {
+	PID  int
+	Name string
+}
+
+// LogArchiveOptions limits the entries included in a log archive. Zero
+// values are not sent to the device.
+type LogArchiveOptions struct {
+	// SizeLimit is the maximum size of the archive in bytes.
+	SizeLimit int64
+
+	// AgeLimit is the maximum age of the entries in seconds.
+	AgeLimit int64
+
+	// StartTime is the time of the oldest entry.
+	StartTime time.Time
+}
+
+type startActivityRequest struct {
+	Request       string
+	MessageFilter int
+	Pid           int
+	StreamFlags   int
+}
+
+type pidListRequest struct {
+	Request string
+}
+
+type pidListResponse struct {
+	Status  string
+	Payload map[string]struct {
+		ProcessName string
+	}
+}
+
+type createArchiveRequest struct {
+	Request   string
+	SizeLimit int64 `plist:",omitempty"`
+	AgeLimit  int64 `plist:",omitempty"`
+	StartTime int64 `plist:",omitempty"`
+}
+
+type osTraceResponse struct {
+	Status string
+	Error  string
+}
+
+// OSTraceRelay is a client of com.apple.os_trace_relay, which streams the
+// unified log with its structure intact, lists processes and creates log
+// archives.
+//
+// The service handles a single request per connection, so a new relay has
+// to be started for every request.
+type OSTraceRelay struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	started bool
+}
+
+func newOSTraceRelay(conn net.Conn) *OSTraceRelay {
+	return &OSTraceRelay{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// OSLog starts streaming the unified log of the device. Entries are read
+// with Next until the relay is closed. A pid of -1 streams the entries of
+// all processes.
+func OSLog(device *Device, pid int) (*OSTraceRelay, error) {
+	relay, err := osTraceRelayService(device)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := relay.StartActivity(pid); err != nil {
+		relay.Close()
+		return nil, err
+	}
+
+	return relay, nil
+}
+
+// ProcessList returns the processes running on the device, ordered by PID.
+func ProcessList(device *Device) ([]OSProcess, error) {
+	relay, err := osTraceRelayService(device)
+	if err != nil {
+		return nil, err
+	}
+	defer relay.Close()
+
+	return relay.PidList()
+}
+
+// CreateLogArchive writes a tarball of the device's logarchive to w.
+func CreateLogArchive(device *Device, w io.Writer, opts *LogArchiveOptions) error {
+	relay, err := osTraceRelayService(device)
+	if err != nil {
+		return err
+	}
+	defer relay.Close()
+
+	return relay.CreateArchive(w, opts)
+}
+
+func osTraceRelayService(device *Device) (*OSTraceRelay, error) {
+	lockdown, err := LockdownService(device)
+	if err != nil {
+		return nil, fmt.Errorf("lockdown: %v", err)
+	}
+
+	relay, err := lockdown.OSTraceRelayService()
+	if err != nil {
+		return nil, fmt.Errorf("os trace relay: %v", err)
+	}
+
+	return relay, nil
+}
+
+// StartActivity asks the device to stream the log entries of the process,
+// or of all processes if pid is -1.
+func (o *OSTraceRelay) StartActivity(pid int) error {
+	req := startActivityRequest{
+		Request:       "StartActivity",
+		MessageFilter: 65535,
+		Pid:           pid,
+		StreamFlags:   60,
+	}
+	if err := sendPlist(o.conn, req); err != nil {
+		return err
+	}
+
+	// the response is prefixed with the little-endian length of its length
+	var lengthSize uint32
+	if err := binary.Read(o.r, binary.LittleEndian, &lengthSize); err != nil {
+		return err
+	}
+	if lengthSize == 0 || lengthSize > 8 {
+		return fmt.Errorf("invalid response length size %d", lengthSize)
+	}
+
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(o.r, b[:lengthSize]); err != nil {
+		return err
+	}
+	length := binary.LittleEndian.Uint64(b)
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(o.r, payload); err != nil {
+		return err
+	}
+
+	log.Printf("<< %s\n", payload)
+
+	resp := &osTraceResponse{}
+	if _, err := plist.Unmarshal(payload, resp); err != nil {
+		return err
+	}
+
+	if resp.Status != "RequestSuccessful" {
+		return fmt.Errorf("start activity: %s %s", resp.Status, resp.Error)
+	}
+
+	o.started = true
+
+	return nil
+}
+
+// Next blocks until the next log entry is received.
+func (o *OSTraceRelay) Next() (*OSLogEntry, error) {
+	if !o.started {
+		return nil, ErrActivityNotStarted
+	}
+
+	marker, err := o.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if marker != 0x02 {
+		return nil, fmt.Errorf("unexpected entry marker 0x%02x", marker)
+	}
+
+	var length uint32
+	if err := binary.Read(o.r, binary.LittleEndian, &length); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(o.r, data); err != nil {
+		return nil, err
+	}
+
+	return parseOSLogEntry(data)
+}
+
+// PidList returns the processes running on the device, ordered by PID.
+func (o *OSTraceRelay) PidList() ([]OSProcess, error) {
+	if err := sendPlist(o.conn, pidListRequest{Request: "PidList"}); err != nil {
+		return nil, err
+	}
+
+	// the response is preceded by a single byte of unknown purpose
+	if _, err := o.r.ReadByte(); err != nil {
+		return nil, err
+	}
+
+	resp := &pidListResponse{}
+	if err := receivePlist(o.r, resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Status != "RequestSuccessful" {
+		return nil, fmt.Errorf("pid list: %s", resp.Status)
+	}
+
+	processes := make([]OSProcess, 0, len(resp.Payload))
+	for k, v := range resp.Payload {
+		pid, err := strconv.Atoi(k)
+		if err != nil {
+			continue
+		}
+		processes = append(processes, OSProcess{PID: pid, Name: v.ProcessName})
+	}
+
+	sort.Slice(processes, func(i, j int) bool {
+		return processes[i].PID < processes[j].PID
+	})
+
+	return processes, nil
+}
+
+// CreateArchive writes a tarball of the device's logarchive to w. The
+// device closes the connection once the whole archive has been sent.
+func (o *OSTraceRelay) CreateArchive(w io.Writer, opts *LogArchiveOptions) error {
+	req := createArchiveRequest{Request: "CreateArchive"}
+	if opts != nil {
+		req.SizeLimit = opts.SizeLimit
+		req.AgeLimit = opts.AgeLimit
+		if !opts.StartTime.IsZero() {
+			req.StartTime = opts.StartTime.Unix()
+		}
+	}
+	if err := sendPlist(o.conn, req); err != nil {
+		return err
+	}
+
+	marker, err := o.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if marker != 0x01 {
+		return fmt.Errorf("unexpected response marker 0x%02x", marker)
+	}
+
+	resp := &osTraceResponse{}
+	if err := receivePlist(o.r, resp); err != nil {
+		return err
+	}
+
+	if resp.Status != "RequestSuccessful" {
+		return fmt.Errorf("create archive: %s %s", resp.Status, resp.Error)
+	}
+
+	for {
+		marker, err := o.r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if marker != 0x03 {
+			return fmt.Errorf("unexpected chunk marker 0x%02x", marker)
+		}
+
+		var length uint32
+		if err := binary.Read(o.r, binary.LittleEndian, &length); err != nil {
+			return err
+		}
+
+		if _, err := io.CopyN(w, o.r, int64(length)); err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the connection to the service, which also stops streaming.
+func (o *OSTraceRelay) Close() error {
+	return o.conn.Close()
+}
+
+// osLogEntryHeaderSize is the size of the fixed part of a log entry, which
+// is followed by the NUL terminated filename, image name, message,
+// subsystem and category.
+const osLogEntryHeaderSize = 129
+
+func parseOSLogEntry(data []byte) (*OSLogEntry, error) {
+	if len(data) < osLogEntryHeaderSize {
+		return nil, fmt.Errorf("log entry too short: %d bytes", len(data))
+	}
+
+	le := binary.LittleEndian
+
+	pid := le.Uint32(data[9:])
+	seconds := le.Uint32(data[55:])
+	microseconds := le.Uint32(data[63:])
+	level := data[68]
+	imageNameSize := int(le.Uint16(data[107:]))
+	messageSize := int(le.Uint16(data[109:]))
+	subsystemSize := int(le.Uint32(data[117:]))
+	categorySize := int(le.Uint32(data[121:]))
+
+	strs := data[osLogEntryHeaderSize:]
+
+	end := bytes.IndexByte(strs, 0)
+	if end < 0 {
+		return nil, errors.New("log entry filename not terminated")
+	}
+	entry := &OSLogEntry{
+		Time:     time.Unix(int64(seconds), int64(microseconds)*int64(time.Microsecond)),
+		PID:      int(pid),
+		Level:    OSLogLevel(level),
+		Filename: string(strs[:end]),
+	}
+	strs = strs[end+1:]
+
+	fields := []struct {
+		size int
+		dst  *string
+	}{
+		{imageNameSize, &entry.ImageName},
+		{messageSize, &entry.Message},
+		{subsystemSize, &entry.Subsystem},
+		{categorySize, &entry.Category},
+	}
+	for _, f := range fields {
+		if f.size < 0 || f.size > len(strs) {
+			return nil, errors.New("log entry strings out of range")
+		}
+		*f.dst = string(bytes.TrimRight(strs[:f.size], "\x00"))
+		strs = strs[f.size:]
+	}
+
+	return entry, nil
+}
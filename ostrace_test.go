@@ -0,0 +1,128 @@
+package xcdevice
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+// osLogFrame is the payload of an entry in the os_trace_relay layout: the
+// fixed size header, with unused bytes filled so misplaced offsets show up,
+// followed by the filename, image name, message, subsystem and category.
+var osLogFrame, _ = hex.DecodeString("" +
+	"0b30557a9fc4e90e3339000000ec11365b80a5caef14395e83a8cdf2173c6186" +
+	"abd0f51a3f6489aed3f81d42678cb1d6fb20456a8fb4d9d50bd56a92b7dc0140" +
+	"e20100ba1004294e7398bde2072c51769bc0e50a2f54799ec3e80d32577ca1c6" +
+	"eb10355a7fa4c9ee13385d42001500163b6085aacf15000000070000001c4166" +
+	"8b2f53797374656d2f4c6962726172792f436f726553657276696365732f5370" +
+	"72696e67426f6172642e6170702f537072696e67426f617264002f5379737465" +
+	"6d2f4c6962726172792f507269766174654672616d65776f726b732f46726f6e" +
+	"74426f6172642e6672616d65776f726b2f46726f6e74426f617264004170706c" +
+	"69636174696f6e206c61756e6368656400636f6d2e6170706c652e46726f6e74" +
+	"426f61726400436f6d6d6f6e00")
+
+func TestParseOSLogEntry(t *testing.T) {
+	entry, err := parseOSLogEntry(osLogFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := OSLogEntry{
+		Time:      time.Unix(1792347093, 123456*int64(time.Microsecond)),
+		PID:       57,
+		Level:     OSLogLevelError,
+		Filename:  "/System/Library/CoreServices/SpringBoard.app/SpringBoard",
+		ImageName: "/System/Library/PrivateFrameworks/FrontBoard.framework/FrontBoard",
+		Message:   "Application launched",
+		Subsystem: "com.apple.FrontBoard",
+		Category:  "Common",
+	}
+	if !entry.Time.Equal(want.Time) {
+		t.Errorf("Time = %v, want %v", entry.Time, want.Time)
+	}
+	entry.Time = want.Time
+	if *entry != want {
+		t.Errorf("entry = %+v, want %+v", *entry, want)
+	}
+	if entry.Process() != "SpringBoard" {
+		t.Errorf("Process = %q", entry.Process())
+	}
+}
+
+func TestParseOSLogEntryWithoutSubsystem(t *testing.T) {
+	frame := make([]byte, osLogEntryHeaderSize)
+	binary.LittleEndian.PutUint16(frame[107:], 1)
+	binary.LittleEndian.PutUint16(frame[109:], 6)
+	frame = append(frame, "/usr/libexec/test\x00\x00hello\x00"...)
+
+	entry, err := parseOSLogEntry(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Filename != "/usr/libexec/test" || entry.ImageName != "" || entry.Message != "hello" ||
+		entry.Subsystem != "" || entry.Category != "" || entry.Level != OSLogLevelNotice {
+		t.Errorf("entry = %+v", entry)
+	}
+}
+
+func TestParseOSLogEntryErrors(t *testing.T) {
+	// every truncation has to fail rather than panic
+	for i := 0; i < len(osLogFrame); i++ {
+		if _, err := parseOSLogEntry(osLogFrame[:i]); err == nil {
+			t.Errorf("truncated to %d bytes: expected an error", i)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func([]byte)
+	}{
+		{"unterminated filename", func(b []byte) {
+			for i := osLogEntryHeaderSize; i < len(b); i++ {
+				b[i] = 'a'
+			}
+		}},
+		{"image name size", func(b []byte) { binary.LittleEndian.PutUint16(b[107:], 0xffff) }},
+		{"message size", func(b []byte) { binary.LittleEndian.PutUint16(b[109:], 0xffff) }},
+		{"subsystem size", func(b []byte) { binary.LittleEndian.PutUint32(b[117:], 0xffffffff) }},
+		{"category size", func(b []byte) { binary.LittleEndian.PutUint32(b[121:], 0x80000000) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			frame := append([]byte{}, osLogFrame...)
+			tc.modify(frame)
+			if _, err := parseOSLogEntry(frame); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestOSTraceRelayNext(t *testing.T) {
+	client, device := net.Pipe()
+	defer device.Close()
+
+	go func() {
+		header := make([]byte, 5)
+		header[0] = 0x02
+		binary.LittleEndian.PutUint32(header[1:], uint32(len(osLogFrame)))
+		device.Write(append(header, osLogFrame...))
+	}()
+
+	relay := newOSTraceRelay(client)
+	defer relay.Close()
+
+	if _, err := relay.Next(); err != ErrActivityNotStarted {
+		t.Fatalf("err = %v, want %v", err, ErrActivityNotStarted)
+	}
+
+	relay.started = true
+	entry, err := relay.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.PID != 57 || entry.Message != "Application launched" {
+		t.Errorf("entry = %+v", entry)
+	}
+}
@@ -0,0 +1,100 @@
+package xcdevice
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"net"
+
+	"golang.org/x/image/tiff"
+)
+
+// Screenshotr is a client of com.apple.mobile.screenshotr, which captures
+// the screen of the device. The service is only available when a developer
+// disk image is mounted.
+type Screenshotr struct {
+	link *deviceLink
+}
+
+func newScreenshotr(conn net.Conn) (*Screenshotr, error) {
+	link := &deviceLink{conn}
+	if err := link.versionExchange(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("version exchange: %v", err)
+	}
+	return &Screenshotr{link}, nil
+}
+
+// Screenshot captures the screen of the device and returns it as a PNG
+// image.
+func Screenshot(device *Device) ([]byte, error) {
+	lockdown, err := LockdownService(device)
+	if err != nil {
+		return nil, fmt.Errorf("lockdown: %v", err)
+	}
+
+	screenshotr, err := lockdown.ScreenshotrService()
+	if err != nil {
+		return nil, fmt.Errorf("screenshotr: %v", err)
+	}
+	defer screenshotr.Close()
+
+	data, err := screenshotr.TakeScreenshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return screenshotPNG(data)
+}
+
+// TakeScreenshot captures the screen of the device. The image is returned
+// as sent by the device, which is PNG on recent versions of iOS and TIFF on
+// older ones.
+func (s *Screenshotr) TakeScreenshot() ([]byte, error) {
+	reply, err := s.link.processMessage(map[string]interface{}{
+		"MessageType": "ScreenShotRequest",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if t, _ := reply["MessageType"].(string); t != "ScreenShotReply" {
+		return nil, fmt.Errorf("unexpected reply %q", t)
+	}
+
+	data, ok := reply["ScreenShotData"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("reply has no screenshot data")
+	}
+
+	return data, nil
+}
+
+// Close disconnects from the service.
+func (s *Screenshotr) Close() error {
+	return s.link.disconnect()
+}
+
+// screenshotPNG converts a screenshot to PNG if it is not one already.
+func screenshotPNG(data []byte) ([]byte, error) {
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unknown screenshot format")
+	}
+	if format == "png" {
+		return data, nil
+	}
+
+	img, err := tiff.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("tiff: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return nil, fmt.Errorf("png: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
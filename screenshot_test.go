@@ -0,0 +1,57 @@
+package xcdevice
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+func TestScreenshotPNG(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	img.Set(0, 0, color.NRGBA{0xff, 0, 0, 0xff})
+	img.Set(2, 1, color.NRGBA{0, 0, 0xff, 0x80})
+
+	pngData := &bytes.Buffer{}
+	if err := png.Encode(pngData, img); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := screenshotPNG(pngData.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, pngData.Bytes()) {
+		t.Error("PNG screenshot was re-encoded")
+	}
+
+	tiffData := &bytes.Buffer{}
+	if err := tiff.Encode(tiffData, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err = screenshotPNG(tiffData.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bounds() != img.Bounds() {
+		t.Fatalf("bounds = %v, want %v", decoded.Bounds(), img.Bounds())
+	}
+	for _, p := range []image.Point{{0, 0}, {1, 0}, {2, 1}} {
+		want := color.NRGBAModel.Convert(img.At(p.X, p.Y))
+		if got := color.NRGBAModel.Convert(decoded.At(p.X, p.Y)); got != want {
+			t.Errorf("pixel %v = %v, want %v", p, got, want)
+		}
+	}
+
+	if _, err := screenshotPNG([]byte("not an image")); err == nil {
+		t.Error("expected an error for unknown data")
+	}
+}
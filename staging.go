@@ -0,0 +1,37 @@
+package xcdevice
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+// CleanStaging removes everything from the PublicStaging directory, e.g.
+// packages left behind by interrupted installs.
+func CleanStaging(device *Device) error {
+	lockdown, err := LockdownService(device)
+	if err != nil {
+		return fmt.Errorf("lockdown: %v", err)
+	}
+
+	afc, err := lockdown.AFCService()
+	if err != nil {
+		return fmt.Errorf("afc: %v", err)
+	}
+
+	names, err := afc.ReadDirectory(stagingPath)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	for _, name := range names {
+		if err := afc.RemoveAll(path.Join(stagingPath, name)); err != nil {
+			return fmt.Errorf("remove %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
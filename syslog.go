@@ -0,0 +1,164 @@
+package xcdevice
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syslogLinePattern matches lines like
+//
+//	Oct 18 18:11:33 iPhone SpringBoard(FrontBoard)[57] <Notice>: message
+var syslogLinePattern = regexp.MustCompile(`(?s)^(\w{3}\s+\d+\s+\d{2}:\d{2}:\d{2})\s+(\S+)\s+([^\[\(]+?)(?:\(([^\)]*)\))?(?:\[(\d+)\])?\s+<(\w+)>:\s?(.*)$`)
+
+// SyslogLine is a single entry of the device's system log.
+type SyslogLine struct {
+	// Time is the timestamp of the entry. The log does not include the
+	// year, so the one closest to the time the line was received is
+	// assumed.
+	Time time.Time
+
+	Device  string
+	Process string
+
+	// Image is the library or plugin that logged the message, if it is
+	// not the process executable, e.g. "FrontBoard".
+	Image string `json:",omitempty"`
+
+	// PID is 0 if the line does not include one.
+	PID     int
+	Level   string
+	Message string
+
+	// Raw is the line as it was received. It is the only field that is set
+	// when the line could not be parsed.
+	Raw string
+}
+
+func (l *SyslogLine) String() string {
+	return l.Raw
+}
+
+// SyslogRelay streams the system log of the device through
+// com.apple.syslog_relay.
+type SyslogRelay struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newSyslogRelay(conn net.Conn) *SyslogRelay {
+	return &SyslogRelay{conn, bufio.NewReader(conn)}
+}
+
+// Syslog starts streaming the system log of the device. Lines are read with
+// Next until the relay is closed.
+func Syslog(device *Device) (*SyslogRelay, error) {
+	lockdown, err := LockdownService(device)
+	if err != nil {
+		return nil, fmt.Errorf("lockdown: %v", err)
+	}
+
+	relay, err := lockdown.SyslogRelayService()
+	if err != nil {
+		return nil, fmt.Errorf("syslog relay: %v", err)
+	}
+
+	return relay, nil
+}
+
+// Next blocks until the next line of the log is received. Lines are
+// separated by NUL bytes in the stream, so a single line may span several
+// lines of text.
+func (s *SyslogRelay) Next() (*SyslogLine, error) {
+	for {
+		raw, err := s.r.ReadString(0)
+		if err != nil {
+			return nil, err
+		}
+
+		raw = strings.TrimRight(raw, "\x00\n")
+		if raw == "" {
+			continue
+		}
+
+		return parseSyslogLine(unvis(raw), time.Now()), nil
+	}
+}
+
+// Close stops the stream.
+func (s *SyslogRelay) Close() error {
+	return s.conn.Close()
+}
+
+func parseSyslogLine(raw string, now time.Time) *SyslogLine {
+	line := &SyslogLine{Raw: raw}
+
+	m := syslogLinePattern.FindStringSubmatch(raw)
+	if m == nil {
+		return line
+	}
+
+	if t, err := time.ParseInLocation(time.Stamp, m[1], time.Local); err == nil {
+		line.Time = t.AddDate(now.Year(), 0, 0)
+
+		// lines logged around new year may belong to the year before or
+		// after, depending on which clock is ahead
+		switch {
+		case line.Time.Sub(now) > 182*24*time.Hour:
+			line.Time = line.Time.AddDate(-1, 0, 0)
+		case now.Sub(line.Time) > 182*24*time.Hour:
+			line.Time = line.Time.AddDate(1, 0, 0)
+		}
+	}
+	line.Device = m[2]
+	line.Process = m[3]
+	line.Image = m[4]
+	if m[5] != "" {
+		line.PID, _ = strconv.Atoi(m[5])
+	}
+	line.Level = m[6]
+	line.Message = m[7]
+
+	return line
+}
+
+// unvis decodes the vis(3) escapes syslog uses for non-printable and
+// non-ASCII bytes, e.g. "\M-b\M^@\M-&" for "…" or "\033" for ESC.
+func unvis(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], `\M-`) && i+3 < len(s):
+			b = append(b, s[i+3]|0x80)
+			i += 3
+		case strings.HasPrefix(s[i:], `\M^`) && i+3 < len(s):
+			b = append(b, (s[i+3]^0x40)|0x80)
+			i += 3
+		case strings.HasPrefix(s[i:], `\^`) && i+2 < len(s):
+			b = append(b, s[i+2]^0x40)
+			i += 2
+		case i+3 < len(s) && s[i] == '\\' && isOctal(s[i+1:i+4]):
+			n, _ := strconv.ParseUint(s[i+1:i+4], 8, 8)
+			b = append(b, byte(n))
+			i += 3
+		default:
+			b = append(b, s[i])
+		}
+	}
+
+	return string(b)
+}
+
+func isOctal(s string) bool {
+	return s[0] >= '0' && s[0] <= '3' &&
+		s[1] >= '0' && s[1] <= '7' &&
+		s[2] >= '0' && s[2] <= '7'
+}
@@ -0,0 +1,196 @@
+package xcdevice
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSyslogLine(t *testing.T) {
+	now := time.Date(2026, time.October, 18, 18, 12, 0, 0, time.Local)
+
+	for _, tc := range []struct {
+		name string
+		raw  string
+		now  time.Time
+		want SyslogLine
+	}{
+		{
+			name: "normal line",
+			raw:  "Oct 18 18:11:33 iPhone SpringBoard[57] <Notice>: Application launched",
+			want: SyslogLine{
+				Time:    time.Date(2026, time.October, 18, 18, 11, 33, 0, time.Local),
+				Device:  "iPhone",
+				Process: "SpringBoard",
+				PID:     57,
+				Level:   "Notice",
+				Message: "Application launched",
+			},
+		},
+		{
+			name: "image",
+			raw:  "Oct  8 08:01:02 iPhone SpringBoard(FrontBoard)[57] <Error>: failed",
+			want: SyslogLine{
+				Time:    time.Date(2026, time.October, 8, 8, 1, 2, 0, time.Local),
+				Device:  "iPhone",
+				Process: "SpringBoard",
+				Image:   "FrontBoard",
+				PID:     57,
+				Level:   "Error",
+				Message: "failed",
+			},
+		},
+		{
+			name: "missing PID",
+			raw:  "Oct 18 18:11:33 iPhone kernel(Sandbox) <Warning>: deny",
+			want: SyslogLine{
+				Time:    time.Date(2026, time.October, 18, 18, 11, 33, 0, time.Local),
+				Device:  "iPhone",
+				Process: "kernel",
+				Image:   "Sandbox",
+				Level:   "Warning",
+				Message: "deny",
+			},
+		},
+		{
+			name: "process with spaces",
+			raw:  "Oct 18 18:11:33 iPhone Web Content[301] <Debug>: loaded",
+			want: SyslogLine{
+				Time:    time.Date(2026, time.October, 18, 18, 11, 33, 0, time.Local),
+				Device:  "iPhone",
+				Process: "Web Content",
+				PID:     301,
+				Level:   "Debug",
+				Message: "loaded",
+			},
+		},
+		{
+			name: "empty message",
+			raw:  "Oct 18 18:11:33 iPhone backboardd[60] <Info>:",
+			want: SyslogLine{
+				Time:    time.Date(2026, time.October, 18, 18, 11, 33, 0, time.Local),
+				Device:  "iPhone",
+				Process: "backboardd",
+				PID:     60,
+				Level:   "Info",
+			},
+		},
+		{
+			name: "multiline message",
+			raw:  "Oct 18 18:11:33 iPhone backboardd[60] <Notice>: first\nsecond",
+			want: SyslogLine{
+				Time:    time.Date(2026, time.October, 18, 18, 11, 33, 0, time.Local),
+				Device:  "iPhone",
+				Process: "backboardd",
+				PID:     60,
+				Level:   "Notice",
+				Message: "first\nsecond",
+			},
+		},
+		{
+			name: "line from last year",
+			raw:  "Dec 31 23:59:59 iPhone SpringBoard[57] <Notice>: old",
+			now:  time.Date(2027, time.January, 1, 0, 0, 1, 0, time.Local),
+			want: SyslogLine{
+				Time:    time.Date(2026, time.December, 31, 23, 59, 59, 0, time.Local),
+				Device:  "iPhone",
+				Process: "SpringBoard",
+				PID:     57,
+				Level:   "Notice",
+				Message: "old",
+			},
+		},
+		{
+			name: "device clock ahead at new year",
+			raw:  "Jan  1 00:00:01 iPhone SpringBoard[57] <Notice>: new",
+			now:  time.Date(2026, time.December, 31, 23, 59, 59, 0, time.Local),
+			want: SyslogLine{
+				Time:    time.Date(2027, time.January, 1, 0, 0, 1, 0, time.Local),
+				Device:  "iPhone",
+				Process: "SpringBoard",
+				PID:     57,
+				Level:   "Notice",
+				Message: "new",
+			},
+		},
+		{
+			name: "missing level",
+			raw:  "Oct 18 18:11:33 iPhone SpringBoard[57]: message",
+		},
+		{
+			name: "empty level",
+			raw:  "Oct 18 18:11:33 iPhone SpringBoard[57] <>: message",
+		},
+		{
+			name: "not a syslog line",
+			raw:  "=== BEGIN ===",
+		},
+		{
+			name: "empty",
+			raw:  "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.now.IsZero() {
+				tc.now = now
+			}
+			tc.want.Raw = tc.raw
+
+			got := parseSyslogLine(tc.raw, tc.now)
+			if !got.Time.Equal(tc.want.Time) {
+				t.Errorf("Time = %v, want %v", got.Time, tc.want.Time)
+			}
+			got.Time = tc.want.Time
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Errorf("line = %+v, want %+v", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUnvis(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"plain text", "plain text"},
+		{`\M-b\M^@\M-&`, "…"},
+		{`caf\M-C\M-)`, "café"},
+		{`\^[[0m`, "\x1b[0m"},
+		{`\^?`, "\x7f"},
+		{`\M^?`, "\xff"},
+		{`\033[1m`, "\x1b[1m"},
+		{`tab\011end`, "tab\tend"},
+		{`\342\200\246`, "…"},
+		{`C:\path`, `C:\path`},
+		{`\999`, `\999`},
+		{`\400`, `\400`},
+		{`trailing \`, `trailing \`},
+		{`trailing \M-`, `trailing \M-`},
+		{`trailing \^`, `trailing \^`},
+		{`trailing \03`, `trailing \03`},
+	} {
+		if got := unvis(tc.in); got != tc.want {
+			t.Errorf("unvis(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSyslogRelay(t *testing.T) {
+	client, device := net.Pipe()
+	defer device.Close()
+
+	go device.Write([]byte("Oct 18 18:11:33 iPhone SpringBoard[57] <Notice>: caf\\M-C\\M-)\n\x00\x00\n\x00"))
+
+	relay := newSyslogRelay(client)
+	defer relay.Close()
+
+	line, err := relay.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line.Process != "SpringBoard" || line.Message != "café" {
+		t.Errorf("line = %+v", line)
+	}
+}
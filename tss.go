@@ -0,0 +1,257 @@
+package xcdevice
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"howett.net/plist"
+)
+
+// tssURL is Apple's signing server, which personalizes images for a device.
+const tssURL = "http://gs.apple.com/TSS/controller?action=2"
+
+// tssClient is the HTTP client used for TSS requests.
+var tssClient = &http.Client{Timeout: time.Minute}
+
+// ErrNoBuildIdentity is returned when the build manifest of a personalized
+// image has no build identity for the board and chip of the device.
+var ErrNoBuildIdentity = errors.New("no build identity for device")
+
+// tssParameters are the parameters restore request rules are evaluated
+// against.
+var tssParameters = map[string]interface{}{
+	"ApProductionMode": true,
+	"ApSecurityDomain": uint64(1),
+	"ApSecurityMode":   true,
+	"ApSupportsImg4":   true,
+}
+
+// personalizationRequest describes the device an image is personalized for.
+type personalizationRequest struct {
+	// identifiers are the PersonalizationIdentifiers of the image mounter,
+	// which include BoardId, ChipID and the "Ap," prefixed keys.
+	identifiers map[string]interface{}
+
+	ecid  uint64
+	nonce []byte
+}
+
+// buildIdentity returns the build identity of the manifest matching the
+// board and chip of the device.
+func buildIdentity(buildManifest map[string]interface{}, identifiers map[string]interface{}) (map[string]interface{}, error) {
+	boardID, _ := identifiers["BoardId"].(uint64)
+	chipID, _ := identifiers["ChipID"].(uint64)
+
+	identities, _ := buildManifest["BuildIdentities"].([]interface{})
+	for _, i := range identities {
+		identity, ok := i.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		board, _ := identity["ApBoardID"].(string)
+		chip, _ := identity["ApChipID"].(string)
+
+		b, err := strconv.ParseUint(board, 0, 64)
+		if err != nil {
+			continue
+		}
+		c, err := strconv.ParseUint(chip, 0, 64)
+		if err != nil {
+			continue
+		}
+
+		if b == boardID && c == chipID {
+			return identity, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: board 0x%x, chip 0x%x", ErrNoBuildIdentity, boardID, chipID)
+}
+
+// personalizationManifest asks Apple's signing server for an image manifest
+// ticket of the build identity for the device.
+func personalizationManifest(identity map[string]interface{}, req *personalizationRequest) ([]byte, error) {
+	boardID, _ := req.identifiers["BoardId"].(uint64)
+	chipID, _ := req.identifiers["ChipID"].(uint64)
+
+	uuid := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, uuid); err != nil {
+		return nil, err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+
+	tss := map[string]interface{}{
+		"@HostPlatformInfo": "mac",
+		"@VersionInfo":      "libauthinstall-973.40.2",
+		"@UUID":             fmt.Sprintf("%X-%X-%X-%X-%X", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]),
+		"@ApImg4Ticket":     true,
+		"@BBTicket":         true,
+		"ApBoardID":         boardID,
+		"ApChipID":          chipID,
+		"ApECID":            req.ecid,
+		"ApNonce":           req.nonce,
+		"ApProductionMode":  true,
+		"ApSecurityDomain":  uint64(1),
+		"ApSecurityMode":    true,
+		"SepNonce":          make([]byte, 20),
+		"UID_MODE":          false,
+	}
+
+	for k, v := range req.identifiers {
+		if strings.HasPrefix(k, "Ap,") {
+			tss[k] = v
+		}
+	}
+
+	manifest, _ := identity["Manifest"].(map[string]interface{})
+	for name, v := range manifest {
+		item, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		info, ok := item["Info"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if trusted, _ := item["Trusted"].(bool); !trusted {
+			continue
+		}
+
+		entry := make(map[string]interface{}, len(item))
+		for k, v := range item {
+			if k != "Info" {
+				entry[k] = v
+			}
+		}
+
+		if rules, ok := info["RestoreRequestRules"].([]interface{}); ok {
+			applyRestoreRequestRules(entry, rules)
+		}
+
+		// trusted entries need a digest, even if it is empty
+		if _, ok := entry["Digest"]; !ok {
+			entry["Digest"] = []byte{}
+		}
+
+		tss[name] = entry
+	}
+
+	resp, err := sendTSSRequest(tss)
+	if err != nil {
+		return nil, err
+	}
+
+	ticket, ok := resp["ApImg4Ticket"].([]byte)
+	if !ok {
+		return nil, errors.New("tss: response has no ApImg4Ticket")
+	}
+
+	return ticket, nil
+}
+
+// applyRestoreRequestRules applies the actions of the rules whose conditions
+// match tssParameters to the entry.
+func applyRestoreRequestRules(entry map[string]interface{}, rules []interface{}) {
+	for _, r := range rules {
+		rule, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		conditions, _ := rule["Conditions"].(map[string]interface{})
+
+		matches := true
+		for k, v := range conditions {
+			var param string
+			switch k {
+			case "ApRawProductionMode", "ApCurrentProductionMode":
+				param = "ApProductionMode"
+			case "ApRawSecurityMode":
+				param = "ApSecurityMode"
+			case "ApRequiresImage4":
+				param = "ApSupportsImg4"
+			case "ApDemotionPolicyOverride":
+				param = "DemotionPolicy"
+			case "ApInRomDFU":
+				param = "ApInRomDFU"
+			}
+
+			p, ok := tssParameters[param]
+			if !ok || p != v {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+
+		actions, _ := rule["Actions"].(map[string]interface{})
+		for k, v := range actions {
+			// 255 means the value is left as it is
+			if n, ok := v.(uint64); ok && n == 255 {
+				continue
+			}
+			entry[k] = v
+		}
+	}
+}
+
+// sendTSSRequest posts the request to the signing server. The server
+// responds with "STATUS=0&MESSAGE=SUCCESS&REQUEST_STRING=<plist>".
+func sendTSSRequest(tss map[string]interface{}) (map[string]interface{}, error) {
+	body, err := plist.MarshalIndent(tss, plist.XMLFormat, "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, tssURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("User-Agent", "InetURL/1.0")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	resp, err := tssClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("tss: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("tss: %v", err)
+	}
+
+	text := string(data)
+	const requestString = "REQUEST_STRING="
+
+	i := strings.Index(text, requestString)
+	if !strings.HasPrefix(text, "STATUS=0&") || i < 0 {
+		message := text
+		if j := strings.Index(text, "MESSAGE="); j >= 0 {
+			message = text[j+len("MESSAGE="):]
+			if k := strings.Index(message, "&"); k >= 0 {
+				message = message[:k]
+			}
+		}
+		return nil, fmt.Errorf("tss: %s", message)
+	}
+
+	result := make(map[string]interface{})
+	if _, err := plist.Unmarshal([]byte(text[i+len(requestString):]), &result); err != nil {
+		return nil, fmt.Errorf("tss: %v", err)
+	}
+
+	return result, nil
+}
@@ -1,6 +1,6 @@
 package xcdevice
 
-func Uninstall(device *Device, bundleID string) error {
+func Uninstall(device *Device, bundleID string, progress ProgressFunc) error {
 	lockdown, err := LockdownService(device)
 	if err != nil {
 		return err
@@ -11,7 +11,7 @@ func Uninstall(device *Device, bundleID string) error {
 		return err
 	}
 
-	if err := installationProxy.UninstallApplication(bundleID); err != nil {
+	if err := installationProxy.UninstallApplication(bundleID, progress); err != nil {
 		return err
 	}
 
@@ -69,6 +69,19 @@ type header struct {
 	Tag uint32
 }
 
+type connectRequest struct {
+	MessageType         string
+	ProgName            string
+	ClientVersionString string
+	DeviceID            int
+	PortNumber          uint16
+}
+
+type connectResponse struct {
+	MessageType string
+	Number      ReplyCode
+}
+
 type message struct {
 	Header  header
 	Payload []byte
@@ -82,6 +95,49 @@ func Open() (*Connection, error) {
 	return &Connection{0, conn}, nil
 }
 
+// DialDevice connects to a TCP port on the device through usbmuxd. The
+// returned connection is a plain stream to the port, usbmuxd is no longer
+// involved once it is established.
+func DialDevice(device *Device, port int) (net.Conn, error) {
+	if port <= 0 || port > 0xffff {
+		return nil, fmt.Errorf("invalid port %d", port)
+	}
+
+	conn, err := Open()
+	if err != nil {
+		return nil, err
+	}
+
+	// usbmuxd expects the port in network byte order, e.g. 62078 => 32498
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, uint16(port))
+
+	req := connectRequest{
+		MessageType:         "Connect",
+		ProgName:            "xcdevice",
+		ClientVersionString: "xcdevice-0.0.1",
+		DeviceID:            device.DeviceID,
+		PortNumber:          binary.LittleEndian.Uint16(buf),
+	}
+	if err := conn.Send(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp := connectResponse{}
+	if err := conn.Receive(&resp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if resp.Number != ReplyCodeOK {
+		conn.Close()
+		return nil, fmt.Errorf("usbmuxd: connect to port %d: %s", port, resp.Number.String())
+	}
+
+	return conn.Hijack(), nil
+}
+
 func (c *Connection) Send(request interface{}) error {
 	body, err := plist.Marshal(request, plist.XMLFormat)
 	if err != nil {